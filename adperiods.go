@@ -0,0 +1,199 @@
+package mpdgrabber
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattetti/go-dash/mpd"
+)
+
+// defaultAdPeriodIDPattern matches the usual ids of the periods carrying ads
+// (server side ad insertion).
+var defaultAdPeriodIDPattern = regexp.MustCompile(`(?i)(^|[^a-z])(ads?|advert\w*|pre-?roll|mid-?roll|post-?roll|dai|ssai)([^a-z]|$)`)
+
+// defaultMaxAdPeriodDuration is the Options.MaxAdPeriodDuration by default.
+const defaultMaxAdPeriodDuration = 2 * time.Minute
+
+// adDetection configures the heuristics detecting the ad periods, see
+// Options.AdPeriodIDPattern and Options.MaxAdPeriodDuration.
+type adDetection struct {
+	idPattern   *regexp.Regexp
+	maxDuration time.Duration
+}
+
+// scte35SchemePrefix is the prefix of the SCTE-35 EventStream schemes
+// (urn:scte:scte35:2013:xml, urn:scte:scte35:2014:xml+bin...)
+const scte35SchemePrefix = "urn:scte:scte35"
+
+// DownloadReport summarizes what a manifest job downloaded.
+type DownloadReport struct {
+	Periods []PeriodReport
+}
+
+// SkippedPeriods returns the periods that weren't downloaded.
+func (r *DownloadReport) SkippedPeriods() []PeriodReport {
+	var skipped []PeriodReport
+	for _, p := range r.Periods {
+		if p.Skipped {
+			skipped = append(skipped, p)
+		}
+	}
+	return skipped
+}
+
+// PeriodReport describes how a period was classified and handled.
+type PeriodReport struct {
+	ID       string
+	Start    time.Duration
+	Duration time.Duration
+	Ad       bool
+	Skipped  bool
+	// Reason explains why the period was classified as an ad
+	Reason string
+}
+
+func (p PeriodReport) String() string {
+	kind := "content"
+	if p.Ad {
+		kind = "ad"
+	}
+	s := fmt.Sprintf("period %s [%s +%s] %s", p.ID, p.Start, p.Duration, kind)
+	if p.Reason != "" {
+		s += " (" + p.Reason + ")"
+	}
+	if p.Skipped {
+		s += " skipped"
+	}
+	return s
+}
+
+// periodFilter classifies the periods of a manifest as content or ad and
+// drops the ad periods if requested.
+type periodFilter struct {
+	skipAds bool
+	ads     adDetection
+	report  *DownloadReport
+	// classified maps the periods already classified (live refreshes) to
+	// their position in the report
+	classified map[string]int
+	log        *slog.Logger
+}
+
+func newPeriodFilter(skipAds bool, ads adDetection, report *DownloadReport, log *slog.Logger) *periodFilter {
+	return &periodFilter{
+		skipAds:    skipAds,
+		ads:        ads,
+		report:     report,
+		classified: map[string]int{},
+		log:        log,
+	}
+}
+
+// filter classifies the periods of the manifest and returns the selections
+// of the periods to download.
+func (f *periodFilter) filter(m *manifest, manifestURL *url.URL, selections []*trackSelection) []*trackSelection {
+	contentHost := mainContentHost(m, manifestURL)
+	for i, period := range m.Periods {
+		key := periodKey(period, i)
+		if _, ok := f.classified[key]; ok {
+			continue
+		}
+		reason := f.ads.adPeriodReason(m, manifestURL, period, contentHost)
+		f.report.Periods = append(f.report.Periods, PeriodReport{
+			ID:       key,
+			Start:    m.periodStart(period),
+			Duration: m.periodDuration(period),
+			Ad:       reason != "",
+			Skipped:  reason != "" && f.skipAds,
+			Reason:   reason,
+		})
+		f.classified[key] = len(f.report.Periods) - 1
+		if reason != "" {
+			f.log.Info("ad period detected", "period", key, "reason", reason, "skipped", f.skipAds)
+		}
+	}
+
+	kept := selections[:0]
+	for _, sel := range selections {
+		if i, ok := f.classified[sel.PeriodKey]; ok && f.report.Periods[i].Skipped {
+			continue
+		}
+		kept = append(kept, sel)
+	}
+	return kept
+}
+
+// periodKey identifies a period by its id or its position.
+func periodKey(period *mpd.Period, index int) string {
+	if period.ID != "" {
+		return period.ID
+	}
+	return strconv.Itoa(index)
+}
+
+// adPeriodReason returns why the period looks like an ad, or an empty
+// string for content periods.
+// The period id is conclusive. Content periods also carry SCTE-35 events
+// (splice points, program boundaries), so a SCTE-35 event stream, a short
+// duration and media served from another host than the content are signals
+// and a period needs two of them to be considered an ad.
+func (d adDetection) adPeriodReason(m *manifest, manifestURL *url.URL, period *mpd.Period, contentHost string) string {
+	if period.ID != "" && d.idPattern != nil && d.idPattern.MatchString(period.ID) {
+		return "period id"
+	}
+
+	var scte35 bool
+	for _, stream := range period.EventStreams {
+		if strings.HasPrefix(strPtrtoEmpty(stream.SchemeIDURI), scte35SchemePrefix) {
+			scte35 = true
+			break
+		}
+	}
+	duration := m.periodDuration(period)
+	short := len(m.Periods) > 1 && duration > 0 && duration <= d.maxDuration
+	host := periodHost(m, manifestURL, period)
+	otherHost := host != "" && contentHost != "" && host != contentHost
+
+	switch {
+	case scte35 && short:
+		return "SCTE-35 event stream on a short period"
+	case scte35 && otherHost:
+		return fmt.Sprintf("SCTE-35 event stream, served from %s", host)
+	case short && otherHost:
+		return fmt.Sprintf("short period served from %s", host)
+	}
+	return ""
+}
+
+// mainContentHost returns the host serving the longest period.
+func mainContentHost(m *manifest, manifestURL *url.URL) string {
+	var longest *mpd.Period
+	for _, period := range m.Periods {
+		if longest == nil || m.periodDuration(period) > m.periodDuration(longest) {
+			longest = period
+		}
+	}
+	if longest == nil {
+		return ""
+	}
+	return periodHost(m, manifestURL, longest)
+}
+
+// periodHost returns the host of the media of the period, as resolved from
+// the BaseURLs of the first representation.
+func periodHost(m *manifest, manifestURL *url.URL, period *mpd.Period) string {
+	u := absBaseURL(absBaseURL(manifestURL, m.BaseURL), period.BaseURL)
+	if len(period.AdaptationSets) > 0 {
+		as := period.AdaptationSets[0]
+		u = absBaseURL(u, as.BaseURL)
+		if len(as.Representations) > 0 {
+			u = absBaseURL(u, as.Representations[0].BaseURL)
+		}
+	}
+	return u.Host
+}
@@ -0,0 +1,107 @@
+package mpdgrabber
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAdPeriodReason(t *testing.T) {
+	const scte35 = `<EventStream schemeIdUri="urn:scte:scte35:2014:xml+bin" timescale="90000"><Event presentationTime="0" duration="2700000" id="1"/></EventStream>`
+	const contentAS = `<AdaptationSet mimeType="video/mp4"><SegmentTemplate media="$Number$.m4s" duration="2" timescale="1"/><Representation id="v" bandwidth="1000"/></AdaptationSet>`
+	const adAS = `<AdaptationSet mimeType="video/mp4"><BaseURL>https://ads.example.net/</BaseURL><SegmentTemplate media="$Number$.m4s" duration="2" timescale="1"/><Representation id="v" bandwidth="1000"/></AdaptationSet>`
+	tests := []struct {
+		name string
+		// periods are the Periods of a 10 minutes presentation, the tested
+		// period is the one with the id "tested".
+		periods string
+		want    string
+	}{
+		{
+			name:    "SCTE-35 on a long content period",
+			periods: `<Period id="tested" start="PT0S">` + scte35 + contentAS + `</Period><Period id="next" start="PT9M">` + contentAS + `</Period>`,
+			want:    "",
+		},
+		{
+			name:    "SCTE-35 on the only period",
+			periods: `<Period id="tested" start="PT0S">` + scte35 + contentAS + `</Period>`,
+			want:    "",
+		},
+		{
+			name:    "SCTE-35 on a short period",
+			periods: `<Period id="main" start="PT0S">` + contentAS + `</Period><Period id="tested" start="PT5M">` + scte35 + contentAS + `</Period><Period id="main2" start="PT5M30S">` + contentAS + `</Period>`,
+			want:    "SCTE-35 event stream on a short period",
+		},
+		{
+			name:    "SCTE-35 on a long period served by another host",
+			periods: `<Period id="main" start="PT0S">` + contentAS + `</Period><Period id="tested" start="PT5M">` + scte35 + adAS + `</Period><Period id="main2" start="PT8M">` + contentAS + `</Period>`,
+			want:    "SCTE-35 event stream, served from ads.example.net",
+		},
+		{
+			name:    "short period served by another host",
+			periods: `<Period id="main" start="PT0S">` + contentAS + `</Period><Period id="tested" start="PT5M">` + adAS + `</Period><Period id="main2" start="PT5M30S">` + contentAS + `</Period>`,
+			want:    "short period served from ads.example.net",
+		},
+		{
+			name:    "short content period",
+			periods: `<Period id="main" start="PT0S">` + contentAS + `</Period><Period id="tested" start="PT5M">` + contentAS + `</Period><Period id="main2" start="PT5M30S">` + contentAS + `</Period>`,
+			want:    "",
+		},
+		{
+			name:    "ad period id",
+			periods: `<Period id="main" start="PT0S">` + contentAS + `</Period><Period id="tested-preroll" start="PT5M">` + contentAS + `</Period>`,
+			want:    "period id",
+		},
+	}
+
+	manifestURL, _ := url.Parse("https://cdn.example.com/vod/manifest.mpd")
+	ads := adDetection{idPattern: defaultAdPeriodIDPattern, maxDuration: defaultMaxAdPeriodDuration}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := readManifest([]byte(`<?xml version="1.0"?><MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static" mediaPresentationDuration="PT10M">` + tt.periods + `</MPD>`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			contentHost := mainContentHost(m, manifestURL)
+			for _, period := range m.Periods {
+				if !strings.HasPrefix(period.ID, "tested") {
+					continue
+				}
+				if got := ads.adPeriodReason(m, manifestURL, period, contentHost); got != tt.want {
+					t.Errorf("adPeriodReason() = %q, want %q", got, tt.want)
+				}
+				return
+			}
+			t.Fatal("tested period not found")
+		})
+	}
+}
+
+func TestJobSkipAdPeriodsOverridesTheGrabber(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		name    string
+		grabber bool
+		job     *bool
+		want    bool
+	}{
+		{"grabber setting", true, nil, true},
+		{"job disables", true, &no, false},
+		{"job enables", false, &yes, true},
+		{"disabled", false, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, err := NewGrabber(Options{SkipAdPeriods: tt.grabber, Logger: discardLogger})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer g.Close()
+			job := &WJob{SkipAdPeriods: tt.job}
+			g.setup(job)
+			if job.skipAds != tt.want {
+				t.Errorf("skipAds = %t, want %t", job.skipAds, tt.want)
+			}
+		})
+	}
+}
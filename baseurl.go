@@ -0,0 +1,315 @@
+package mpdgrabber
+
+import (
+	"log/slog"
+	"math/rand"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DVB defaults (ETSI TS 103 285 §10.8.2.1)
+const (
+	defaultBaseURLPriority = 1
+	defaultBaseURLWeight   = 1
+)
+
+// baseURL is one of the alternative locations of a representation.
+type baseURL struct {
+	URL             *url.URL
+	ServiceLocation string
+	Priority        int
+	Weight          int
+	// weighted is set when a DVB weight was explicitly set
+	weighted bool
+}
+
+// baseURLsOf returns the BaseURL elements of an element of the manifest
+// (*mpd.MPD, *mpd.Period, *mpd.AdaptationSet or *mpd.Representation).
+// go-dash only keeps the values, the attributes come from the manifest
+// extensions when the elements could be paired.
+func (m *manifest) baseURLsOf(owner interface{}, values []string) []*baseURLExt {
+	if exts, ok := m.baseURLs[owner]; ok && len(exts) == len(values) {
+		return exts
+	}
+	exts := make([]*baseURLExt, 0, len(values))
+	for _, v := range values {
+		exts = append(exts, &baseURLExt{Value: v})
+	}
+	return exts
+}
+
+// resolveBaseURLs resolves the BaseURL elements of a level against each
+// alternative of the parent level. Without BaseURL, the parent alternatives
+// are inherited.
+func resolveBaseURLs(parents []*baseURL, elements []*baseURLExt, log *slog.Logger) []*baseURL {
+	if len(elements) == 0 {
+		return parents
+	}
+	var resolved []*baseURL
+	seen := map[string]bool{}
+	add := func(b *baseURL) {
+		if !seen[b.URL.String()] {
+			seen[b.URL.String()] = true
+			resolved = append(resolved, b)
+		}
+	}
+
+	for _, el := range elements {
+		u, err := url.Parse(strings.TrimSpace(el.Value))
+		if err != nil {
+			log.Warn("failed to parse the base url", "url", el.Value, "err", err)
+			continue
+		}
+		// an absolute url doesn't depend on the parent
+		if u.IsAbs() {
+			add(newBaseURL(u, el, nil))
+			continue
+		}
+		for _, parent := range parents {
+			add(newBaseURL(parent.URL.ResolveReference(u), el, parent))
+		}
+	}
+	if len(resolved) == 0 {
+		return parents
+	}
+	return resolved
+}
+
+// newBaseURL builds an alternative from a BaseURL element, relative urls
+// inherit the attributes of their parent.
+func newBaseURL(u *url.URL, el *baseURLExt, parent *baseURL) *baseURL {
+	b := &baseURL{
+		URL:      u,
+		Priority: defaultBaseURLPriority,
+		Weight:   defaultBaseURLWeight,
+	}
+	if parent != nil {
+		b.ServiceLocation = parent.ServiceLocation
+		b.Priority = parent.Priority
+		b.Weight = parent.Weight
+		b.weighted = parent.weighted
+	}
+	if el.ServiceLocation != nil {
+		b.ServiceLocation = *el.ServiceLocation
+	}
+	if el.Priority != nil {
+		b.Priority = *el.Priority
+	}
+	if el.Weight != nil {
+		b.Weight = *el.Weight
+		b.weighted = true
+	}
+	return b
+}
+
+// orderBaseURLs sorts the alternatives by DVB priority (lowest first), the
+// alternatives sharing a priority are shuffled according to their weight if
+// one is set, otherwise the document order is kept.
+func orderBaseURLs(bases []*baseURL) []*baseURL {
+	ordered := make([]*baseURL, len(bases))
+	copy(ordered, bases)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].Priority < ordered[j].Priority
+	})
+
+	for start := 0; start < len(ordered); {
+		end := start + 1
+		for end < len(ordered) && ordered[end].Priority == ordered[start].Priority {
+			end++
+		}
+		weightedShuffle(ordered[start:end])
+		start = end
+	}
+	return ordered
+}
+
+// weightedShuffle orders the alternatives by picking them randomly in
+// proportion to their weight.
+func weightedShuffle(bases []*baseURL) {
+	weighted := false
+	for _, b := range bases {
+		weighted = weighted || b.weighted
+	}
+	if !weighted {
+		return
+	}
+	for i := range bases {
+		total := 0
+		for _, b := range bases[i:] {
+			total += b.Weight
+		}
+		if total <= 0 {
+			return
+		}
+		pick := rand.Intn(total)
+		for j := i; j < len(bases); j++ {
+			pick -= bases[j].Weight
+			if pick < 0 {
+				bases[i], bases[j] = bases[j], bases[i]
+				break
+			}
+		}
+	}
+}
+
+// mirrorURL returns the url of a resource resolved against the primary base
+// url, resolved against an alternative base url instead.
+// Resources that don't live under the primary base url have no mirror.
+func mirrorURL(resourceURL string, primary, alternative *url.URL) (string, bool) {
+	// the base url is the file of a single file representation, the
+	// alternative is that file on another location
+	if stripQuery(resourceURL) == stripQuery(primary.String()) {
+		mirror := *alternative
+		if mirror.RawQuery == "" {
+			if u, err := url.Parse(resourceURL); err == nil {
+				mirror.RawQuery = u.RawQuery
+			}
+		}
+		return mirror.String(), true
+	}
+	// a file doesn't mirror the resources of a directory
+	if isDirURL(primary) && !isDirURL(alternative) {
+		return "", false
+	}
+	primaryDir := baseDir(primary)
+	if !strings.HasPrefix(resourceURL, primaryDir) {
+		return "", false
+	}
+	return baseDir(alternative) + strings.TrimPrefix(resourceURL, primaryDir), true
+}
+
+// isDirURL returns true if the path of the url ends with a slash.
+func isDirURL(u *url.URL) bool {
+	return u.Path == "" || strings.HasSuffix(u.Path, "/")
+}
+
+// baseDir returns the url up to the last slash of its path, what relative
+// references are resolved against.
+func baseDir(u *url.URL) string {
+	dir := *u
+	dir.RawQuery, dir.Fragment = "", ""
+	if i := strings.LastIndex(dir.Path, "/"); i >= 0 {
+		dir.Path = dir.Path[:i+1]
+		dir.RawPath = ""
+	}
+	return dir.String()
+}
+
+// addSegmentMirrors sets the urls of the segments on the alternative base
+// urls of the selection.
+func addSegmentMirrors(segments []*Segment, sel *trackSelection) {
+	if len(sel.BaseURLs) < 2 {
+		return
+	}
+	for _, segment := range segments {
+		segment.Mirrors = segment.Mirrors[:0]
+		for _, alt := range sel.BaseURLs[1:] {
+			if mirror, ok := mirrorURL(segment.URL, sel.BaseURL, alt.URL); ok && mirror != segment.URL {
+				segment.Mirrors = append(segment.Mirrors, mirror)
+			}
+		}
+	}
+}
+
+// hostHealth keeps track of the hosts that failed during a job so the
+// following requests go to the healthy ones first.
+type hostHealth struct {
+	mu        sync.Mutex
+	unhealthy map[string]bool
+	// locations maps the hosts to their @serviceLocation, hosts sharing a
+	// service location are considered the same CDN.
+	locations map[string]string
+	// steering ranks the service locations when content steering is used
+	steering *contentSteering
+}
+
+func newHostHealth() *hostHealth {
+	return &hostHealth{
+		unhealthy: map[string]bool{},
+		locations: map[string]string{},
+	}
+}
+
+// register records the service locations of the alternatives.
+func (h *hostHealth) register(bases []*baseURL) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, b := range bases {
+		if b.ServiceLocation != "" {
+			h.locations[b.URL.Host] = b.ServiceLocation
+		}
+	}
+}
+
+// fail marks the host of the url, and the hosts of the same service
+// location, as unhealthy for the rest of the job.
+func (h *hostHealth) fail(rawURL string) {
+	if h == nil {
+		return
+	}
+	host := hostOf(rawURL)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.unhealthy[host] = true
+	if location := h.locations[host]; location != "" {
+		for otherHost, otherLocation := range h.locations {
+			if otherLocation == location {
+				h.unhealthy[otherHost] = true
+			}
+		}
+	}
+}
+
+func (h *hostHealth) isHealthy(rawURL string) bool {
+	if h == nil {
+		return true
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return !h.unhealthy[hostOf(rawURL)]
+}
+
+// order returns the urls on healthy hosts first, following the content
+// steering pathway priority if any, the order is kept otherwise.
+func (h *hostHealth) order(urls []string) []string {
+	ordered := make([]string, 0, len(urls))
+	var unhealthy []string
+	for _, u := range urls {
+		if h.isHealthy(u) {
+			ordered = append(ordered, u)
+		} else {
+			unhealthy = append(unhealthy, u)
+		}
+	}
+	if h != nil && h.steering != nil {
+		h.sortBySteering(ordered)
+		h.sortBySteering(unhealthy)
+	}
+	// all the hosts failing doesn't mean they will keep failing
+	return append(ordered, unhealthy...)
+}
+
+func (h *hostHealth) sortBySteering(urls []string) {
+	ranks := make(map[string]int, len(urls))
+	h.mu.Lock()
+	for _, u := range urls {
+		ranks[u] = h.steering.rank(h.locations[hostOf(u)])
+	}
+	h.mu.Unlock()
+	sort.SliceStable(urls, func(i, j int) bool {
+		return ranks[urls[i]] < ranks[urls[j]]
+	})
+}
+
+func hostOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
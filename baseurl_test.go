@@ -0,0 +1,161 @@
+package mpdgrabber
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSegmentFailuresDemotingTheHost(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing.m4s":
+			http.NotFound(w, r)
+		case "/error_page.m4s":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html>error</html>"))
+		default:
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+		}
+	}))
+	defer primary.Close()
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// an empty mp4 box
+		w.Write([]byte("\x00\x00\x00\x08free"))
+	}))
+	defer mirror.Close()
+
+	tests := []struct {
+		segment string
+		demoted bool
+	}{
+		{"missing.m4s", false},
+		{"error_page.m4s", false},
+		{"overloaded.m4s", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.segment, func(t *testing.T) {
+			hosts := newHostHealth()
+			job := &WJob{
+				URL:          primary.URL + "/" + tt.segment,
+				Mirrors:      []string{mirror.URL + "/" + tt.segment},
+				AbsolutePath: filepath.Join(t.TempDir(), "seg"),
+				hosts:        hosts,
+				client:       http.DefaultClient,
+				payload:      &payloadCheck{container: containerMP4},
+				log:          discardLogger,
+			}
+			w := &Worker{}
+			f, err := w.downloadSegmentMirrors(context.Background(), job)
+			if err != nil {
+				t.Fatalf("the segment wasn't downloaded from the mirror - %v", err)
+			}
+			f.Close()
+
+			urls := []string{primary.URL + "/next.m4s", mirror.URL + "/next.m4s"}
+			want := urls
+			if tt.demoted {
+				want = []string{urls[1], urls[0]}
+			}
+			if got := hosts.order(urls); !reflect.DeepEqual(got, want) {
+				t.Errorf("order() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestMirrorURL(t *testing.T) {
+	tests := []struct {
+		name        string
+		resource    string
+		primary     string
+		alternative string
+		want        string
+	}{
+		{
+			name:        "segment under a directory",
+			resource:    "https://a.example.com/vod/video/seg_1.m4s",
+			primary:     "https://a.example.com/vod/",
+			alternative: "https://b.example.com/mirror/vod/",
+			want:        "https://b.example.com/mirror/vod/video/seg_1.m4s",
+		},
+		{
+			name:        "single file",
+			resource:    "https://a.example.com/vod/video.mp4",
+			primary:     "https://a.example.com/vod/video.mp4",
+			alternative: "https://b.example.com/files/video_1080.mp4",
+			want:        "https://b.example.com/files/video_1080.mp4",
+		},
+		{
+			name:        "single file with the query of the manifest",
+			resource:    "https://a.example.com/vod/video.mp4?token=1",
+			primary:     "https://a.example.com/vod/video.mp4",
+			alternative: "https://b.example.com/files/video_1080.mp4",
+			want:        "https://b.example.com/files/video_1080.mp4?token=1",
+		},
+		{
+			name:        "file alternative of a directory",
+			resource:    "https://a.example.com/vod/seg_1.m4s",
+			primary:     "https://a.example.com/vod/",
+			alternative: "https://b.example.com/vod/video.mp4",
+			want:        "",
+		},
+		{
+			name:        "resource on another location",
+			resource:    "https://c.example.com/seg_1.m4s",
+			primary:     "https://a.example.com/vod/",
+			alternative: "https://b.example.com/vod/",
+			want:        "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary, _ := url.Parse(tt.primary)
+			alternative, _ := url.Parse(tt.alternative)
+			got, ok := mirrorURL(tt.resource, primary, alternative)
+			if got != tt.want || ok != (tt.want != "") {
+				t.Errorf("mirrorURL() = %q, %t, want %q", got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestSingleFileFailover(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusBadGateway)
+	}))
+	defer primary.Close()
+	var requested string
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = r.URL.Path
+		w.Write([]byte("\x00\x00\x00\x08free"))
+	}))
+	defer mirror.Close()
+
+	primaryURL, _ := url.Parse(primary.URL + "/vod/video.mp4")
+	mirrorBase, _ := url.Parse(mirror.URL + "/files/video_1080.mp4")
+	sel := &trackSelection{BaseURL: primaryURL, BaseURLs: []*baseURL{{URL: primaryURL}, {URL: mirrorBase}}}
+	segments := []*Segment{{URL: primaryURL.String()}}
+	addSegmentMirrors(segments, sel)
+
+	job := &WJob{
+		URL:          segments[0].URL,
+		Mirrors:      segments[0].Mirrors,
+		AbsolutePath: filepath.Join(t.TempDir(), "video.mp4"),
+		hosts:        newHostHealth(),
+		client:       http.DefaultClient,
+		log:          discardLogger,
+	}
+	f, err := (&Worker{}).downloadSegmentMirrors(context.Background(), job)
+	if err != nil {
+		t.Fatalf("the file wasn't downloaded from the alternative BaseURL - %v", err)
+	}
+	f.Close()
+	if requested != "/files/video_1080.mp4" {
+		t.Errorf("the mirror requested %s, want /files/video_1080.mp4", requested)
+	}
+}
@@ -1,14 +1,21 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
 	"strings"
-	"sync"
+	"syscall"
 
 	"github.com/mattetti/mpdgrabber"
+	"github.com/mattetti/mpdgrabber/subs"
 )
 
 const (
@@ -26,8 +33,45 @@ var (
 	videoOnlyFlag  = flag.Bool("video-only", false, "Download only the video tracks.")
 	textOnlyFlag   = flag.Bool("text-only", false, "Download only the text tracks.")
 	langsOnlyFlag  = flag.String("langs-only", "", "Download only the text tracks for the specified languages (comma separated).")
+	splitPeriods   = flag.Bool("split-periods", false, "Write each period to its own output file instead of stitching them together.")
+	skipAdsFlag    = flag.Bool("skip-ads", false, "Skip the periods detected as ads (ad period ids, or at least two of: SCTE-35 events, a short duration, media served by another host).")
+	queryPolicy    = flag.String("query-policy", "none", "How the manifest url query (signed tokens) is added to the segment urls on the same host: none, copy or merge.")
+	liveDuration   = flag.Duration("live-duration", 0, "Duration of live streams to record (e.g. 1h30m), 0 records until the stream ends or ctrl+c is pressed.")
+	liveFromStart  = flag.Bool("live-from-start", false, "Record live streams from the start of the DVR window instead of the live edge.")
+	userAgentFlag  = flag.String("user-agent", "", "User-Agent sent with all the requests.")
+	refererFlag    = flag.String("referer", "", "Referer header sent with the manifest and segment requests.")
+	originFlag     = flag.String("origin", "", "Origin header sent with the manifest and segment requests.")
+	proxyFlag      = flag.String("proxy", "", "HTTP or SOCKS5 proxy url (e.g. socks5://127.0.0.1:1080), the environment proxy is used by default.")
+	caCertFlag     = flag.String("ca-cert", "", "PEM file of certificate authorities to trust in addition to the system ones.")
+	clientCertFlag = flag.String("client-cert", "", "PEM client certificate for mutual TLS authentication.")
+	clientKeyFlag  = flag.String("client-key", "", "PEM key of the client certificate.")
+	retriesFlag    = flag.Int("retries", mpdgrabber.DefaultRetryOptions.MaxRetries, "Number of retries of a failed segment download.")
+	retryBackoff   = flag.Duration("retry-backoff", mpdgrabber.DefaultRetryOptions.InitialBackoff, "Delay before the first retry, doubled after each retry.")
+	workspaceFlag  = flag.String("workspace-id", "", "Name of the folder holding the downloaded segments, the manifest url and the track flags are used by default. Running the same download again resumes it.")
+	noProgressFlag = flag.Bool("no-progress", false, "Don't draw the progress of the tracks, only the log lines.")
+	headerFlags    = headerList{}
 )
 
+func init() {
+	flag.Var(&headerFlags, "header", `Header sent with the manifest and segment requests, "Name: value" (repeatable, e.g. -header "Authorization: Bearer xyz").`)
+}
+
+// headerList collects the repeated -header flags.
+type headerList []string
+
+func (h *headerList) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerList) Set(value string) error {
+	name, _, ok := strings.Cut(value, ":")
+	if !ok || strings.TrimSpace(name) == "" {
+		return fmt.Errorf("invalid header %q, expected \"Name: value\"", value)
+	}
+	*h = append(*h, value)
+	return nil
+}
+
 func main() {
 
 	flag.Usage = func() {
@@ -38,50 +82,164 @@ func main() {
 	flag.Parse()
 	mpdArgCheck()
 
-	mpdgrabber.Debug = *debugFlag
-	if mpdgrabber.Debug {
-		mpdgrabber.Logger.Println("Downloading", *URLFlag)
-		fmt.Println()
-	}
-
+	var contentTypes []mpdgrabber.ContentType
 	if *audioOnlyFlag {
-		mpdgrabber.AudioDownloadEnabled = true
-		mpdgrabber.VideoDownloadEnabled = false
-		mpdgrabber.TextDownloadEnabled = false
+		contentTypes = []mpdgrabber.ContentType{mpdgrabber.ContentTypeAudio}
 	} else if *videoOnlyFlag {
-		mpdgrabber.AudioDownloadEnabled = false
-		mpdgrabber.VideoDownloadEnabled = true
-		mpdgrabber.TextDownloadEnabled = false
+		contentTypes = []mpdgrabber.ContentType{mpdgrabber.ContentTypeVideo}
 	} else if *textOnlyFlag {
-		mpdgrabber.AudioDownloadEnabled = false
-		mpdgrabber.VideoDownloadEnabled = false
-		mpdgrabber.TextDownloadEnabled = true
+		contentTypes = []mpdgrabber.ContentType{mpdgrabber.ContentTypeText}
 	}
 
+	var langs []string
 	if *langsOnlyFlag != "" {
-		mpdgrabber.LangFilter = strings.Split(*langsOnlyFlag, ",")
-		for i, lang := range mpdgrabber.LangFilter {
-			mpdgrabber.LangFilter[i] = strings.TrimSpace(lang)
+		langs = strings.Split(*langsOnlyFlag, ",")
+		for i, lang := range langs {
+			langs[i] = strings.TrimSpace(lang)
 		}
 	}
 
-	wg := &sync.WaitGroup{}
-	stopChan := make(chan bool)
-	mpdgrabber.LaunchWorkers(wg, stopChan)
-
 	pathToUse, err := os.Getwd()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	if err := mpdgrabber.DownloadFromMPDFile(*URLFlag, pathToUse, *outputFileName); err != nil {
-		mpdgrabber.Logger.Printf("Failed to download the mpd file: %s", err)
-		os.Exit(1)
+	liveStop := make(chan struct{})
+	liveOpts := mpdgrabber.LiveOptions{
+		FromStart: *liveFromStart,
+		Duration:  *liveDuration,
+		Stop:      liveStop,
+	}
+	policy, err := mpdgrabber.ParseQueryPolicy(*queryPolicy)
+	if err != nil || policy == mpdgrabber.QueryPolicyRewrite {
+		fmt.Fprintf(os.Stderr, "Invalid -query-policy %s, use none, copy or merge.\n", *queryPolicy)
+		os.Exit(2)
+	}
+
+	header := http.Header{}
+	for _, h := range headerFlags {
+		name, value, _ := strings.Cut(h, ":")
+		header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	if *refererFlag != "" {
+		header.Set("Referer", *refererFlag)
+	}
+	if *originFlag != "" {
+		header.Set("Origin", *originFlag)
+	}
+	// the progress lines are redrawn in place, the log lines are printed
+	// above them
+	var out io.Writer = os.Stdout
+	var onEvent func(mpdgrabber.Event)
+	var display *progressDisplay
+	if !*noProgressFlag && !*debugFlag && isTerminal(os.Stdout) {
+		display = newProgressDisplay(os.Stdout)
+		out = display
+		onEvent = display.handle
+	}
+	level := slog.LevelInfo
+	if *debugFlag {
+		level = slog.LevelDebug
+	}
+	logger := slog.New(slog.NewTextHandler(out, &slog.HandlerOptions{Level: level}))
+	mpdgrabber.Logger = logger
+	subs.Logger = logger
+	logger.Debug("downloading", "url", *URLFlag)
+
+	grabber, err := mpdgrabber.NewGrabber(mpdgrabber.Options{
+		ContentTypes:  contentTypes,
+		Languages:     langs,
+		SplitPeriods:  *splitPeriods,
+		SkipAdPeriods: *skipAdsFlag,
+		QueryPolicy:   policy,
+		OnEvent:       onEvent,
+		Logger:        logger,
+		Retry: &mpdgrabber.RetryOptions{
+			MaxRetries:     *retriesFlag,
+			InitialBackoff: *retryBackoff,
+			MaxBackoff:     mpdgrabber.DefaultRetryOptions.MaxBackoff,
+		},
+		HTTP: mpdgrabber.HTTPOptions{
+			Header:    header,
+			UserAgent: *userAgentFlag,
+			ProxyURL:  *proxyFlag,
+			CAFile:    *caCertFlag,
+			CertFile:  *clientCertFlag,
+			KeyFile:   *clientKeyFlag,
+		},
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid http options:", err)
+		os.Exit(2)
+	}
+
+	job := &mpdgrabber.WJob{
+		Type:        mpdgrabber.ManifestDL,
+		URL:         *URLFlag,
+		DestPath:    pathToUse,
+		Filename:    *outputFileName,
+		Live:        &liveOpts,
+		WorkspaceID: *workspaceFlag,
+	}
+
+	// ctrl+c and SIGTERM abort the download, the downloaded segments are kept
+	// to resume it. The first ctrl+c only stops live recordings, the recorded
+	// segments are still muxed.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigChan
+		if sig == os.Interrupt && job.Recording() {
+			fmt.Fprintln(out, "Stopping the recording, press ctrl+c again to abort")
+			close(liveStop)
+			<-sigChan
+		}
+		signal.Stop(sigChan)
+		fmt.Fprintln(out, "Aborting the download, press ctrl+c again to quit")
+		cancel()
+	}()
+
+	err = grabber.DownloadJobContext(ctx, job)
+	if display != nil {
+		display.finish()
 	}
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			logger.Info("download aborted, run the same command again to resume it")
+			os.Exit(130)
+		}
+		logger.Error("failed to download the mpd file", "err", err)
+		os.Exit(exitCode(err))
+	}
+
+	fmt.Fprintln(out, "Waiting for workers to finish!")
+	grabber.Close()
+}
 
-	mpdgrabber.Close()
-	fmt.Println("Waiting for workers to finish!")
-	wg.Wait()
+// exitCodes are the exit codes of the download errors, 1 is used for the
+// other errors, 2 for invalid arguments and 130 when the download is aborted.
+var exitCodes = []struct {
+	err  error
+	code int
+}{
+	{mpdgrabber.ErrManifestFetch, 3},
+	{mpdgrabber.ErrManifestParse, 4},
+	{mpdgrabber.ErrUnsupportedManifest, 5},
+	{mpdgrabber.ErrSegmentDownload, 6},
+	{mpdgrabber.ErrMissingSegments, 7},
+	{mpdgrabber.ErrMux, 8},
+	{mpdgrabber.ErrFFmpegNotFound, 9},
+}
+
+func exitCode(err error) int {
+	for _, c := range exitCodes {
+		if errors.Is(err, c.err) {
+			return c.code
+		}
+	}
+	return 1
 }
 
 func mpdArgCheck() {
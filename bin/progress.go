@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattetti/mpdgrabber"
+)
+
+const (
+	progressBarWidth = 24
+	// progressRedraw limits how often the progress lines are redrawn
+	progressRedraw = 100 * time.Millisecond
+)
+
+// progressDisplay draws a progress line per track below the log lines, the
+// lines are redrawn in place so it needs a terminal.
+type progressDisplay struct {
+	out io.Writer
+
+	mu       sync.Mutex
+	tracks   []mpdgrabber.TrackInfo
+	progress map[string]mpdgrabber.Progress
+	status   map[string]string
+	overall  mpdgrabber.Progress
+	phase    string
+	// drawn is the number of progress lines on screen
+	drawn    int
+	lastDraw time.Time
+}
+
+func newProgressDisplay(out io.Writer) *progressDisplay {
+	return &progressDisplay{
+		out:      out,
+		progress: map[string]mpdgrabber.Progress{},
+		status:   map[string]string{},
+	}
+}
+
+// isTerminal reports if f is a terminal (character device).
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// handle is the event handler of the download job.
+func (d *progressDisplay) handle(ev mpdgrabber.Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch ev.Type {
+	case mpdgrabber.EventManifestParsed:
+		d.tracks = ev.Tracks
+	case mpdgrabber.EventProgress:
+		if !d.known(ev.Track.ID) {
+			// live tracks can show up after the manifest is parsed
+			d.tracks = append(d.tracks, ev.Track)
+		}
+		d.progress[ev.Track.ID] = ev.Progress
+		d.overall = ev.Overall
+		if time.Since(d.lastDraw) < progressRedraw {
+			return
+		}
+	case mpdgrabber.EventReassemblyStarted:
+		d.status[ev.Track.ID] = "reassembling"
+	case mpdgrabber.EventReassemblyDone:
+		d.status[ev.Track.ID] = "done"
+		if ev.Err != nil {
+			d.status[ev.Track.ID] = "failed"
+		}
+	case mpdgrabber.EventMuxStarted:
+		d.phase = "Muxing " + filepath.Base(ev.Path)
+	case mpdgrabber.EventMuxDone:
+		d.phase = ""
+	default:
+		return
+	}
+	d.redraw()
+}
+
+func (d *progressDisplay) known(id string) bool {
+	for _, t := range d.tracks {
+		if t.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Write prints the log lines above the progress lines.
+func (d *progressDisplay) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.clear()
+	n, err := d.out.Write(p)
+	d.draw()
+	return n, err
+}
+
+// finish draws the final state of the progress lines.
+func (d *progressDisplay) finish() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.redraw()
+}
+
+func (d *progressDisplay) redraw() {
+	d.clear()
+	d.draw()
+}
+
+// clear erases the progress lines, the lock must be held.
+func (d *progressDisplay) clear() {
+	if d.drawn == 0 {
+		return
+	}
+	// move to the first progress line and clear the rest of the screen
+	fmt.Fprintf(d.out, "\033[%dF\033[J", d.drawn)
+	d.drawn = 0
+}
+
+// draw prints the progress lines, the lock must be held.
+func (d *progressDisplay) draw() {
+	d.lastDraw = time.Now()
+	if len(d.tracks) == 0 {
+		return
+	}
+	var b strings.Builder
+	for _, t := range d.tracks {
+		label := fmt.Sprintf("%s %s", t.ContentType, t.RepresentationID)
+		if t.Language != "" {
+			label += " (" + t.Language + ")"
+		}
+		p, ok := d.progress[t.ID]
+		status := d.status[t.ID]
+		if !ok && status == "" {
+			status = "waiting"
+		}
+		b.WriteString(progressLine(label, p, status))
+	}
+	status := d.phase
+	if status == "" && d.overall.Segments > 0 && d.overall.Done+d.overall.Failed == d.overall.Segments {
+		status = "done"
+	}
+	b.WriteString(progressLine("total", d.overall, status))
+	fmt.Fprint(d.out, b.String())
+	d.drawn = len(d.tracks) + 1
+}
+
+// progressLine formats a progress line, the status replaces the throughput
+// and ETA when set.
+func progressLine(label string, p mpdgrabber.Progress, status string) string {
+	filled := 0
+	if p.Segments > 0 {
+		filled = p.Done * progressBarWidth / p.Segments
+	}
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+	line := fmt.Sprintf("%-28.28s [%s] %5d/%-5d %5.1f%%", label, bar, p.Done, p.Segments, p.Percent())
+	if p.Failed > 0 {
+		line += fmt.Sprintf(" %d failed", p.Failed)
+	}
+	if status != "" {
+		return line + "  " + status + "\n"
+	}
+	line += fmt.Sprintf("  %s/s", formatBytes(p.Throughput))
+	if p.ETA > 0 {
+		line += "  ETA " + p.ETA.Round(time.Second).String()
+	}
+	return line + "\n"
+}
+
+func formatBytes(n float64) string {
+	units := []string{"B", "KB", "MB", "GB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
@@ -0,0 +1,85 @@
+package mpdgrabber
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The errors of a download can be checked with errors.Is against the
+// following errors, errors.As gives the details (ManifestError, SegmentError,
+// MuxError).
+var (
+	// ErrManifestFetch is returned when the manifest can't be downloaded.
+	ErrManifestFetch = errors.New("failed to fetch the manifest")
+	// ErrManifestParse is returned when the manifest isn't a valid mpd.
+	ErrManifestParse = errors.New("failed to parse the manifest")
+	// ErrUnsupportedManifest is returned when the manifest uses a feature
+	// that isn't supported or has no track to download.
+	ErrUnsupportedManifest = errors.New("unsupported manifest")
+	// ErrSegmentDownload is returned when a segment can't be downloaded once
+	// the retries are exhausted.
+	ErrSegmentDownload = errors.New("failed to download a segment")
+	// ErrMissingSegments is returned when the segments of a track aren't all
+	// on disk when it's reassembled.
+	ErrMissingSegments = errors.New("missing segments")
+	// ErrMux is returned when ffmpeg fails to mux the tracks.
+	ErrMux = errors.New("failed to mux the tracks")
+	// ErrFFmpegNotFound is returned when ffmpeg isn't installed, it's
+	// required to mux the tracks.
+	ErrFFmpegNotFound = errors.New("ffmpeg wasn't found on your system")
+	// ErrWorkspaceInUse is returned when another job of the process is
+	// downloading to the same workspace.
+	ErrWorkspaceInUse = errors.New("the workspace is used by another job")
+)
+
+// ManifestError is returned when the manifest can't be fetched, parsed or
+// downloaded, errors.Is matches its Kind.
+type ManifestError struct {
+	// Kind is ErrManifestFetch, ErrManifestParse or ErrUnsupportedManifest
+	Kind error
+	URL  string
+	Err  error
+}
+
+func (e *ManifestError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("%v %s", e.Kind, e.URL)
+	}
+	return fmt.Sprintf("%v %s - %v", e.Kind, e.URL, e.Err)
+}
+
+func (e *ManifestError) Unwrap() []error {
+	return []error{e.Kind, e.Err}
+}
+
+// segmentListingError wraps an error listing the segments of the manifest,
+// it's an ErrManifestParse unless the manifest uses a feature that isn't
+// supported.
+func segmentListingError(manifestURL string, err error) error {
+	kind := ErrManifestParse
+	if errors.Is(err, ErrUnsupportedManifest) {
+		kind = ErrUnsupportedManifest
+	}
+	return &ManifestError{Kind: kind, URL: manifestURL, Err: err}
+}
+
+// MuxError is returned when ffmpeg fails, Output is what it printed.
+type MuxError struct {
+	Path   string
+	Args   []string
+	Output string
+	Err    error
+}
+
+func (e *MuxError) Error() string {
+	return fmt.Sprintf("failed to mux %s - %v", e.Path, e.Err)
+}
+
+func (e *MuxError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches ErrMux.
+func (e *MuxError) Is(target error) bool {
+	return target == ErrMux
+}
@@ -0,0 +1,58 @@
+package mpdgrabber
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestManifestErrorKinds(t *testing.T) {
+	const header = `<?xml version="1.0"?><MPD xmlns="urn:mpeg:dash:schema:mpd:2011" `
+	manifests := map[string]string{
+		"/malformed_template.mpd": header + `type="static" mediaPresentationDuration="PT10S"><Period id="0">
+  <AdaptationSet mimeType="video/mp4"><SegmentTemplate media="seg_$Number.m4s" duration="2" timescale="1"/><Representation id="v" bandwidth="1000"/></AdaptationSet>
+</Period></MPD>`,
+		"/no_segments.mpd": header + `type="static" mediaPresentationDuration="PT10S"><Period id="0">
+  <AdaptationSet mimeType="video/mp4"><Representation id="v" bandwidth="1000"><SegmentList duration="2"/></Representation></AdaptationSet>
+</Period></MPD>`,
+		"/live_without_ast.mpd": header + `type="dynamic" minimumUpdatePeriod="PT2S"><Period id="0" start="PT0S">
+  <AdaptationSet mimeType="video/mp4"><SegmentTemplate media="seg_$Number$.m4s" duration="2" timescale="1"/><Representation id="v" bandwidth="1000"/></AdaptationSet>
+</Period></MPD>`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		manifest, ok := manifests[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(manifest))
+	}))
+	defer srv.Close()
+	// the tracks are never muxed
+	t.Setenv("PATH", t.TempDir())
+
+	g, err := NewGrabber(Options{TmpFolder: t.TempDir(), Logger: discardLogger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	tests := []struct {
+		path string
+		want error
+	}{
+		{"/malformed_template.mpd", ErrManifestParse},
+		{"/no_segments.mpd", ErrUnsupportedManifest},
+		{"/live_without_ast.mpd", ErrManifestParse},
+	}
+	for _, tt := range tests {
+		err := g.Download(srv.URL+tt.path, t.TempDir(), "out")
+		if !errors.Is(err, tt.want) {
+			t.Errorf("Download(%s) = %v, want %v", tt.path, err, tt.want)
+		}
+		var manifestErr *ManifestError
+		if !errors.As(err, &manifestErr) {
+			t.Errorf("Download(%s) = %v, want a ManifestError", tt.path, err)
+		}
+	}
+}
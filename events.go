@@ -0,0 +1,297 @@
+package mpdgrabber
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType identifies the events reported to WJob.OnEvent.
+type EventType int
+
+const (
+	// EventManifestParsed lists the selected tracks (Event.Tracks).
+	EventManifestParsed EventType = iota
+	// EventSegmentStarted is sent when a segment download starts.
+	EventSegmentStarted
+	// EventSegmentRetried is sent when a failed segment download is retried
+	// after Event.Delay, Event.Err is the failure.
+	EventSegmentRetried
+	// EventSegmentCompleted is sent when a segment of Event.Bytes is
+	// downloaded.
+	EventSegmentCompleted
+	// EventSegmentFailed is sent when a segment can't be downloaded, once
+	// the retries are exhausted.
+	EventSegmentFailed
+	// EventProgress reports the progress of a track and of the job, it's
+	// sent when segments are queued, completed or failed.
+	EventProgress
+	// EventReassemblyStarted and EventReassemblyDone surround the
+	// reassembly of the segments of a track into Event.Path.
+	EventReassemblyStarted
+	EventReassemblyDone
+	// EventMuxStarted and EventMuxDone surround the muxing of the tracks
+	// into Event.Path.
+	EventMuxStarted
+	EventMuxDone
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventManifestParsed:
+		return "manifest parsed"
+	case EventSegmentStarted:
+		return "segment started"
+	case EventSegmentRetried:
+		return "segment retried"
+	case EventSegmentCompleted:
+		return "segment completed"
+	case EventSegmentFailed:
+		return "segment failed"
+	case EventProgress:
+		return "progress"
+	case EventReassemblyStarted:
+		return "reassembly started"
+	case EventReassemblyDone:
+		return "reassembly done"
+	case EventMuxStarted:
+		return "mux started"
+	case EventMuxDone:
+		return "mux done"
+	default:
+		return UnknownString
+	}
+}
+
+// Event describes a step of a manifest job, the fields set depend on the
+// type of the event.
+type Event struct {
+	Type EventType
+	Time time.Time
+	// Tracks are the selected tracks (EventManifestParsed)
+	Tracks []TrackInfo
+	// Track is the track of the segment, progress and reassembly events
+	Track TrackInfo
+	// Segment is the position of the segment in the track, URL its url
+	Segment int
+	URL     string
+	// Attempt is the attempt number of the segment download, from 1
+	Attempt int
+	// Bytes is the size of the downloaded segment
+	Bytes int64
+	// Delay is the delay before the retry
+	Delay time.Duration
+	// Err is the error of the failed steps
+	Err error
+	// Path is the output file of the reassembly and mux events
+	Path string
+	// Progress is the progress of the track and Overall the one of the job
+	// (EventProgress)
+	Progress Progress
+	Overall  Progress
+}
+
+// TrackInfo describes a track selected for download.
+type TrackInfo struct {
+	// ID identifies the track in the events of the job
+	ID               string
+	ContentType      ContentType
+	RepresentationID string
+	Language         string
+	Codecs           string
+	// Bandwidth is in bits per second
+	Bandwidth int
+}
+
+// Progress is the download progress of a track or of a job, the tracks not
+// queued yet aren't counted in the progress of the job.
+type Progress struct {
+	// Segments is the number of queued segments, Done the number of
+	// segments downloaded or reused from a previous run.
+	Segments int
+	Done     int
+	Reused   int
+	Failed   int
+	// Bytes is the size of the segments downloaded by this run
+	Bytes int64
+	// Throughput is the download rate in bytes per second
+	Throughput float64
+	// ETA is the estimated time left, 0 when unknown
+	ETA time.Duration
+}
+
+// Percent returns the percentage of segments done.
+func (p Progress) Percent() float64 {
+	if p.Segments == 0 {
+		return 0
+	}
+	return float64(p.Done) * 100 / float64(p.Segments)
+}
+
+// newTrackInfo describes the track made of the selected representations.
+func newTrackInfo(selections []*trackSelection) TrackInfo {
+	first := selections[0]
+	r := first.Representation
+	cType, _ := contentTypeFor(first.ContentType)
+	return TrackInfo{
+		ID:               first.PeriodKey + "/" + first.key(),
+		ContentType:      cType,
+		RepresentationID: strPtrtoS(r.ID),
+		Language:         strPtrtoEmpty(first.AdaptationSet.Lang),
+		Codecs:           repCodecs(r),
+		Bandwidth:        int(int64PtrToI(r.Bandwidth)),
+	}
+}
+
+// jobEvents sends the events of a manifest job to its handler and tracks
+// the progress of the job, it's nil without handler.
+type jobEvents struct {
+	handler func(Event)
+
+	// mu serializes the calls to the handler
+	mu     sync.Mutex
+	start  time.Time
+	tracks map[string]*trackProgress
+}
+
+type trackProgress struct {
+	start    time.Time
+	progress Progress
+}
+
+func newJobEvents(handler func(Event)) *jobEvents {
+	if handler == nil {
+		return nil
+	}
+	return &jobEvents{handler: handler, tracks: map[string]*trackProgress{}}
+}
+
+// emit sends the event, the lock must be held.
+func (e *jobEvents) emit(ev Event) {
+	ev.Time = time.Now()
+	e.handler(ev)
+}
+
+func (e *jobEvents) send(ev Event) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.emit(ev)
+}
+
+func (e *jobEvents) manifestParsed(tracks []TrackInfo) {
+	e.send(Event{Type: EventManifestParsed, Tracks: tracks})
+}
+
+// queued records the segments queued for the track, reused of them were
+// downloaded by a previous run.
+func (e *jobEvents) queued(track TrackInfo, segments, reused int) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	p := e.track(track.ID)
+	p.progress.Segments += segments
+	p.progress.Done += reused
+	p.progress.Reused += reused
+	e.emitProgress(track, p)
+}
+
+func (e *jobEvents) segmentStarted(job *WJob) {
+	e.send(Event{Type: EventSegmentStarted, Track: job.track, Segment: job.Pos, URL: job.URL})
+}
+
+func (e *jobEvents) segmentRetried(job *WJob, delay time.Duration, err error) {
+	e.send(Event{Type: EventSegmentRetried, Track: job.track, Segment: job.Pos, URL: job.URL, Attempt: job.attempts, Delay: delay, Err: err})
+}
+
+func (e *jobEvents) segmentCompleted(job *WJob, size int64) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.emit(Event{Type: EventSegmentCompleted, Track: job.track, Segment: job.Pos, URL: job.URL, Attempt: job.attempts, Bytes: size})
+	p := e.track(job.track.ID)
+	p.progress.Done++
+	p.progress.Bytes += size
+	e.emitProgress(job.track, p)
+}
+
+func (e *jobEvents) segmentFailed(job *WJob, err error) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.emit(Event{Type: EventSegmentFailed, Track: job.track, Segment: job.Pos, URL: job.URL, Attempt: job.attempts, Err: err})
+	p := e.track(job.track.ID)
+	p.progress.Failed++
+	e.emitProgress(job.track, p)
+}
+
+func (e *jobEvents) reassembly(track TrackInfo, path string, done bool, err error) {
+	evType := EventReassemblyStarted
+	if done {
+		evType = EventReassemblyDone
+	}
+	e.send(Event{Type: evType, Track: track, Path: path, Err: err})
+}
+
+func (e *jobEvents) mux(path string, done bool, err error) {
+	evType := EventMuxStarted
+	if done {
+		evType = EventMuxDone
+	}
+	e.send(Event{Type: evType, Path: path, Err: err})
+}
+
+// track returns the progress of the track, the lock must be held.
+func (e *jobEvents) track(id string) *trackProgress {
+	p, ok := e.tracks[id]
+	if !ok {
+		now := time.Now()
+		if e.start.IsZero() {
+			e.start = now
+		}
+		p = &trackProgress{start: now}
+		e.tracks[id] = p
+	}
+	return p
+}
+
+// emitProgress sends the progress of the track and of the job, the lock
+// must be held.
+func (e *jobEvents) emitProgress(track TrackInfo, p *trackProgress) {
+	now := time.Now()
+	var overall Progress
+	for _, t := range e.tracks {
+		overall.Segments += t.progress.Segments
+		overall.Done += t.progress.Done
+		overall.Reused += t.progress.Reused
+		overall.Failed += t.progress.Failed
+		overall.Bytes += t.progress.Bytes
+	}
+	e.emit(Event{
+		Type:     EventProgress,
+		Track:    track,
+		Progress: p.progress.estimate(now.Sub(p.start)),
+		Overall:  overall.estimate(now.Sub(e.start)),
+	})
+}
+
+// estimate sets the throughput and ETA of the progress after elapsed.
+func (p Progress) estimate(elapsed time.Duration) Progress {
+	if elapsed <= 0 {
+		return p
+	}
+	p.Throughput = float64(p.Bytes) / elapsed.Seconds()
+	downloaded := p.Done - p.Reused
+	left := p.Segments - p.Done - p.Failed
+	if downloaded > 0 && left > 0 {
+		p.ETA = elapsed / time.Duration(downloaded) * time.Duration(left)
+	}
+	return p
+}
@@ -1,11 +1,13 @@
 module github.com/mattetti/mpdgrabber
 
-go 1.18
+go 1.21
 
-require github.com/mattetti/go-dash v0.0.0-20230103084621-c2498e421aea
+require (
+	github.com/abema/go-mp4 v0.9.0
+	github.com/mattetti/go-dash v0.0.0-20230103084621-c2498e421aea
+)
 
 require (
-	github.com/abema/go-mp4 v0.9.0 // indirect
 	github.com/google/uuid v1.1.2 // indirect
 	github.com/zencoder/go-dash/v3 v3.0.3 // indirect
 )
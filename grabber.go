@@ -0,0 +1,359 @@
+package mpdgrabber
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultWorkers is the number of segment workers of a Grabber by default.
+const defaultWorkers = 6
+
+// Options configures a Grabber, the zero value downloads all the tracks with
+// the default settings.
+type Options struct {
+	// Workers is the number of segments downloaded concurrently
+	Workers int
+	// TmpFolder holds the job workspaces, os.TempDir()/mpdgrabber by default
+	TmpFolder string
+	// ContentTypes restricts the tracks to download, nil downloads all of
+	// them.
+	ContentTypes []ContentType
+	// Languages restricts the tracks to download, the tracks without
+	// language are always downloaded.
+	Languages []string
+	// SplitPeriods writes each period to its own output file instead of
+	// stitching the periods together.
+	SplitPeriods bool
+	// Logger receives the logs of the grabber, the package Logger is used
+	// if nil.
+	Logger *slog.Logger
+	// SegmentSizeTolerance is how far the size of a media segment can be
+	// from the size announced by its representation (@bandwidth × duration)
+	// before the segment is rejected, 20 by default. A negative value
+	// disables the check.
+	SegmentSizeTolerance float64
+	// AdPeriodIDPattern matches the ids of the periods carrying ads (server
+	// side ad insertion), the usual ids (ad, preroll, ssai...) are matched
+	// if nil.
+	AdPeriodIDPattern *regexp.Regexp
+	// MaxAdPeriodDuration is the maximum duration of a period to be
+	// considered an ad by the duration heuristic, 2 minutes by default.
+	MaxAdPeriodDuration time.Duration
+
+	// The following options are the defaults of the jobs, the options set
+	// on a job take precedence.
+
+	SkipAdPeriods bool
+	QueryPolicy   QueryPolicy
+	RewriteURL    func(resourceURL, manifestURL *url.URL) *url.URL
+	Signer        URLSigner
+	Retry         *RetryOptions
+	OnEvent       func(Event)
+	// Client is used for all the requests, a client is built from HTTP if
+	// nil.
+	Client *http.Client
+	HTTP   HTTPOptions
+}
+
+// Grabber downloads manifests with its own workers and settings, grabbers
+// can run side by side.
+type Grabber struct {
+	opts   Options
+	filter *trackFilter
+	client *http.Client
+
+	// jobs are the manifest jobs, downloaded one at a time, their segments
+	// are downloaded concurrently by the segment workers
+	jobs     chan *WJob
+	segments chan *WJob
+	workers  sync.WaitGroup
+
+	closeOnce sync.Once
+}
+
+// NewGrabber returns a Grabber with its workers started, Close stops them.
+func NewGrabber(opts Options) (*Grabber, error) {
+	if opts.Workers <= 0 {
+		opts.Workers = defaultWorkers
+	}
+	if opts.TmpFolder == "" {
+		opts.TmpFolder = filepath.Join(os.TempDir(), "mpdgrabber")
+	}
+	if opts.SegmentSizeTolerance == 0 {
+		opts.SegmentSizeTolerance = defaultSegmentSizeTolerance
+	}
+	if opts.AdPeriodIDPattern == nil {
+		opts.AdPeriodIDPattern = defaultAdPeriodIDPattern
+	}
+	if opts.MaxAdPeriodDuration <= 0 {
+		opts.MaxAdPeriodDuration = defaultMaxAdPeriodDuration
+	}
+	client := opts.Client
+	if client == nil {
+		var err error
+		client, err = NewHTTPClient(opts.HTTP)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	g := &Grabber{
+		opts:     opts,
+		filter:   newTrackFilter(opts.ContentTypes, opts.Languages),
+		client:   client,
+		jobs:     make(chan *WJob),
+		segments: make(chan *WJob),
+	}
+	g.start()
+	return g, nil
+}
+
+// logger returns the logger of the grabber, resolved on use so the package
+// Logger can be set after the grabber is created.
+func (g *Grabber) logger() *slog.Logger {
+	if g.opts.Logger != nil {
+		return g.opts.Logger
+	}
+	return packageLogger()
+}
+
+func (g *Grabber) start() {
+	// the main worker downloads one full manifest at a time but
+	// segments are downloaded concurrently
+	g.workers.Add(g.opts.Workers + 1)
+	mainW := &Worker{id: 0, g: g, main: true}
+	go mainW.Work()
+
+	for i := 1; i < g.opts.Workers+1; i++ {
+		w := &Worker{id: i, g: g}
+		go w.Work()
+	}
+}
+
+// Download downloads the manifest and muxes its tracks into
+// destPath/filename.mkv.
+func (g *Grabber) Download(manifestURL, destPath, filename string) error {
+	return g.DownloadContext(context.Background(), manifestURL, destPath, filename)
+}
+
+// DownloadContext is like Download but the download is aborted when ctx is
+// done, running it again resumes it.
+func (g *Grabber) DownloadContext(ctx context.Context, manifestURL, destPath, filename string) error {
+	return g.DownloadJobContext(ctx, &WJob{
+		Type:     ManifestDL,
+		URL:      manifestURL,
+		DestPath: destPath,
+		Filename: filename,
+	})
+}
+
+// DownloadJob sends a manifest job to the workers and waits for it to be
+// done, the job report and error are populated.
+func (g *Grabber) DownloadJob(job *WJob) error {
+	return g.DownloadJobContext(context.Background(), job)
+}
+
+// DownloadJobContext is like DownloadJob but the job is aborted when ctx is
+// done: the requests in flight are cancelled, no more segments are queued
+// and ffmpeg is killed. The downloaded segments are kept in the workspace of
+// the job to resume it.
+func (g *Grabber) DownloadJobContext(ctx context.Context, job *WJob) error {
+	if job.Type != ManifestDL {
+		return fmt.Errorf("%s jobs can't be sent directly", job.Type)
+	}
+	job.ctx = ctx
+	job.wg = &sync.WaitGroup{}
+	job.wg.Add(1)
+	select {
+	case g.jobs <- job:
+	case <-ctx.Done():
+		// still waiting for the previous jobs
+		return ctx.Err()
+	}
+	job.wg.Wait()
+
+	return job.Err
+}
+
+// Close waits for the queued jobs and stops the workers, the grabber can't be
+// used afterwards.
+func (g *Grabber) Close() {
+	g.closeJobs()
+	g.workers.Wait()
+}
+
+func (g *Grabber) closeJobs() {
+	g.closeOnce.Do(func() {
+		close(g.jobs)
+	})
+}
+
+// setup resolves the options of a manifest job, the job options take
+// precedence over the grabber ones.
+func (g *Grabber) setup(job *WJob) {
+	job.grabber = g
+	if job.ctx == nil {
+		job.ctx = context.Background()
+	}
+	job.client = job.Client
+	if job.client == nil {
+		job.client = g.client
+	}
+	// the job gets its own copy, the options can be changed while it runs
+	retry := DefaultRetryOptions
+	if job.Retry != nil {
+		retry = *job.Retry
+	} else if g.opts.Retry != nil {
+		retry = *g.opts.Retry
+	}
+	job.retry = &retry
+	if job.Signer == nil {
+		job.Signer = g.opts.Signer
+	}
+	if job.QueryPolicy == QueryPolicyNone {
+		job.QueryPolicy = g.opts.QueryPolicy
+	}
+	if job.RewriteURL == nil {
+		job.RewriteURL = g.opts.RewriteURL
+	}
+	if job.OnEvent == nil {
+		job.OnEvent = g.opts.OnEvent
+	}
+	job.skipAds = g.opts.SkipAdPeriods
+	if job.SkipAdPeriods != nil {
+		job.skipAds = *job.SkipAdPeriods
+	}
+}
+
+// adDetection returns the ad period heuristics of the grabber.
+func (g *Grabber) adDetection() adDetection {
+	return adDetection{idPattern: g.opts.AdPeriodIDPattern, maxDuration: g.opts.MaxAdPeriodDuration}
+}
+
+// workspaceSettings describes the settings selecting what a job downloads,
+// the jobs with other settings don't share their workspace.
+func (g *Grabber) workspaceSettings(job *WJob) string {
+	langs := append([]string(nil), g.filter.langs...)
+	sort.Strings(langs)
+	return fmt.Sprintf("types=%s langs=%s split=%t skip_ads=%t",
+		strings.Join(g.filter.allowedContentTypes(), ","), strings.Join(langs, ","),
+		g.opts.SplitPeriods, job.skipAds)
+}
+
+// trackFilter selects the tracks to download by content type and language.
+type trackFilter struct {
+	audio, video, text bool
+	// inclusive filter, all languages are downloaded if empty
+	langs []string
+}
+
+func newTrackFilter(contentTypes []ContentType, langs []string) *trackFilter {
+	f := &trackFilter{langs: langs}
+	if contentTypes == nil {
+		f.audio, f.video, f.text = true, true, true
+	}
+	for _, t := range contentTypes {
+		switch t {
+		case ContentTypeAudio:
+			f.audio = true
+		case ContentTypeVideo:
+			f.video = true
+		case ContentTypeText:
+			f.text = true
+		}
+	}
+	return f
+}
+
+func (f *trackFilter) skipLang(lang string) bool {
+	if lang == "" || lang == "und" || lang == UnknownString {
+		return false
+	}
+
+	if len(f.langs) == 0 {
+		return false
+	}
+
+	for _, l := range f.langs {
+		if l == lang {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (f *trackFilter) skipContentType(contentType string) bool {
+	// filter content types based on download flags
+	switch contentType {
+	case "video":
+		if !f.video {
+			return true
+		}
+	case "audio":
+		if !f.audio {
+			return true
+		}
+	case "text":
+		if !f.text {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *trackFilter) allowedContentTypes() []string {
+	var allowed []string
+	if f.video {
+		allowed = append(allowed, "video")
+	}
+	if f.audio {
+		allowed = append(allowed, "audio")
+	}
+	if f.text {
+		allowed = append(allowed, "text")
+	}
+	return allowed
+}
+
+// defaultGrabber runs the jobs of the package functions, it's configured
+// with the package variables when LaunchWorkers is called. defaultCtx is
+// cancelled by the stop channel passed to LaunchWorkers.
+var (
+	defaultGrabber *Grabber
+	defaultCtx     context.Context
+)
+
+var errWorkersNotLaunched = errors.New("the workers aren't running, call LaunchWorkers first")
+
+// packageOptions returns the grabber options matching the package variables.
+func packageOptions() Options {
+	contentTypes := []ContentType{}
+	if AudioDownloadEnabled {
+		contentTypes = append(contentTypes, ContentTypeAudio)
+	}
+	if VideoDownloadEnabled {
+		contentTypes = append(contentTypes, ContentTypeVideo)
+	}
+	if TextDownloadEnabled {
+		contentTypes = append(contentTypes, ContentTypeText)
+	}
+	return Options{
+		Workers:      TotalWorkers,
+		TmpFolder:    TmpFolder,
+		ContentTypes: contentTypes,
+		Languages:    LangFilter,
+		SplitPeriods: SplitPeriods,
+	}
+}
@@ -0,0 +1,158 @@
+package mpdgrabber
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+)
+
+// HTTPOptions configures the http client used for the manifest, segment and
+// index requests.
+type HTTPOptions struct {
+	// Header is added to the manifest, segment and index requests (Referer,
+	// Origin, Authorization...). It's not sent to other hosts: redirects to
+	// another host, xlink, content steering or timing servers.
+	Header    http.Header
+	UserAgent string
+	// Jar stores the cookies set by the responses (the manifest response
+	// for instance) and sends them with the following requests, a new jar is
+	// used if nil.
+	Jar http.CookieJar
+	// ProxyURL is the http, https or socks5 proxy to use, the environment
+	// proxy (HTTP_PROXY, HTTPS_PROXY, NO_PROXY) is used if empty.
+	ProxyURL string
+	// CAFile is a PEM file of certificate authorities trusted in addition to
+	// the system ones.
+	CAFile string
+	// CertFile and KeyFile are the PEM client certificate and key to
+	// authenticate with (mTLS).
+	CertFile string
+	KeyFile  string
+}
+
+// NewHTTPClient returns a http client configured with the passed options.
+func NewHTTPClient(opts HTTPOptions) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if opts.ProxyURL != "" {
+		proxyURL, err := url.Parse(opts.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url %s - %w", opts.ProxyURL, err)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %q, use http, https or socks5", proxyURL.Scheme)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if opts.CAFile != "" || opts.CertFile != "" || opts.KeyFile != "" {
+		tlsConfig := &tls.Config{}
+		if opts.CAFile != "" {
+			pem, err := os.ReadFile(opts.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read the CA file - %w", err)
+			}
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				pool = x509.NewCertPool()
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificate found in the CA file %s", opts.CAFile)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		if opts.CertFile != "" || opts.KeyFile != "" {
+			if opts.CertFile == "" || opts.KeyFile == "" {
+				return nil, errors.New("both the client certificate and key files are required")
+			}
+			cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load the client certificate - %w", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	jar := opts.Jar
+	if jar == nil {
+		// can't fail without options
+		jar, _ = cookiejar.New(nil)
+	}
+
+	var rt http.RoundTripper = transport
+	if len(opts.Header) > 0 || opts.UserAgent != "" {
+		rt = &headerTransport{
+			base:      transport,
+			header:    opts.Header.Clone(),
+			userAgent: opts.UserAgent,
+		}
+	}
+	return &http.Client{Transport: rt, Jar: jar}, nil
+}
+
+type headersHostKey struct{}
+
+// withConfiguredHeaders marks a request built by the library (manifest,
+// segment, index), the configured headers are only sent to its host.
+func withConfiguredHeaders(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), headersHostKey{}, req.URL.Host))
+}
+
+// headerTransport adds the configured headers to the requests marked by
+// withConfiguredHeaders, the headers set on a request take precedence. The
+// configured cookies are merged with the ones of the cookie jar.
+// Redirects keep the context of the request so a redirect to another host
+// doesn't get the headers.
+type headerTransport struct {
+	base      http.RoundTripper
+	header    http.Header
+	userAgent string
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a RoundTripper must not modify the request
+	req = req.Clone(req.Context())
+	if host, _ := req.Context().Value(headersHostKey{}).(string); host != "" && host == req.URL.Host {
+		for key, values := range t.header {
+			if http.CanonicalHeaderKey(key) == "Cookie" {
+				addCookies(req, values)
+				continue
+			}
+			if req.Header.Get(key) != "" {
+				continue
+			}
+			for _, v := range values {
+				req.Header.Add(key, v)
+			}
+		}
+	}
+	if t.userAgent != "" && req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// addCookies adds the configured cookies to the ones of the request (set by
+// the cookie jar), the cookies of the jar take precedence since the server
+// set them.
+func addCookies(req *http.Request, values []string) {
+	set := map[string]bool{}
+	for _, c := range req.Cookies() {
+		set[c.Name] = true
+	}
+	configured := &http.Request{Header: http.Header{"Cookie": values}}
+	for _, c := range configured.Cookies() {
+		if !set[c.Name] {
+			req.AddCookie(c)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package mpdgrabber
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfiguredHeadersStayOnTheRequestedHost(t *testing.T) {
+	received := map[string]http.Header{}
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received["other"+r.URL.Path] = r.Header.Clone()
+		w.Write([]byte("<MPD/>"))
+	}))
+	defer other.Close()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received["origin"+r.URL.Path] = r.Header.Clone()
+		switch r.URL.Path {
+		case "/redirect.mpd":
+			http.Redirect(w, r, other.URL+"/moved.mpd", http.StatusFound)
+		case "/local.mpd":
+			http.Redirect(w, r, "/moved.mpd", http.StatusFound)
+		default:
+			w.Write([]byte("<MPD/>"))
+		}
+	}))
+	defer origin.Close()
+
+	client, err := NewHTTPClient(HTTPOptions{
+		Header:    http.Header{"Authorization": {"Bearer secret"}},
+		UserAgent: "test-agent",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	f, err := downloadFileWithClient(ctx, client, origin.URL+"/redirect.mpd", filepath.Join(dir, "redirect.mpd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	f, err = downloadFileWithClient(ctx, client, origin.URL+"/local.mpd", filepath.Join(dir, "local.mpd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err := fetchRemote(ctx, client, origin.URL+"/xlink.xml"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		request string
+		want    string
+	}{
+		{"origin/redirect.mpd", "Bearer secret"},
+		// redirected to another host
+		{"other/moved.mpd", ""},
+		// redirected on the same host
+		{"origin/moved.mpd", "Bearer secret"},
+		// not a request of the stream
+		{"origin/xlink.xml", ""},
+	}
+	for _, tt := range tests {
+		header, ok := received[tt.request]
+		if !ok {
+			t.Errorf("%s wasn't requested", tt.request)
+			continue
+		}
+		if got := header.Get("Authorization"); got != tt.want {
+			t.Errorf("%s Authorization = %q, want %q", tt.request, got, tt.want)
+		}
+		if got := header.Get("User-Agent"); got != "test-agent" {
+			t.Errorf("%s User-Agent = %q, want test-agent", tt.request, got)
+		}
+	}
+}
+
+func TestConfiguredCookiesMergedWithTheJar(t *testing.T) {
+	cookies := map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookies[r.URL.Path] = r.Header.Get("Cookie")
+		if r.URL.Path == "/manifest.mpd" {
+			http.SetCookie(w, &http.Cookie{Name: "cdn", Value: "1", Path: "/"})
+		}
+		w.Write([]byte("data"))
+	}))
+	defer srv.Close()
+
+	client, err := NewHTTPClient(HTTPOptions{Header: http.Header{"Cookie": {"auth=secret"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	dir := t.TempDir()
+	for _, name := range []string{"manifest.mpd", "seg_1.m4s"} {
+		f, err := downloadFileWithClient(ctx, client, srv.URL+"/"+name, filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/manifest.mpd", "auth=secret"},
+		// the cookie set by the manifest response is sent with the
+		// configured one
+		{"/seg_1.m4s", "cdn=1; auth=secret"},
+	}
+	for _, tt := range tests {
+		if got := cookies[tt.path]; got != tt.want {
+			t.Errorf("%s Cookie = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
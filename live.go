@@ -0,0 +1,626 @@
+package mpdgrabber
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mattetti/go-dash/mpd"
+)
+
+// LiveOptions configures the recording of dynamic (live) manifests.
+type LiveOptions struct {
+	// FromStart starts the recording at the beginning of the time shift
+	// buffer (DVR window) instead of the live edge.
+	FromStart bool
+	// Duration stops the recording once that much content was recorded on
+	// every track, 0 records until Stop is closed or the stream ends.
+	Duration time.Duration
+	// Stop ends the recording when closed, the segments already queued are
+	// still downloaded and muxed.
+	Stop <-chan struct{}
+}
+
+const (
+	// liveTick is the delay between two checks for newly available segments
+	liveTick = time.Second
+	// minLiveRefresh is the minimum delay between two manifest refreshes
+	minLiveRefresh = time.Second
+	// liveEdgeWindow is how far behind the live edge the segments are listed
+	// when recording from the live edge, suggestedPresentationDelay extends
+	// it.
+	liveEdgeWindow = time.Minute
+	// maxLiveSegments caps the number of segments listed at once by a
+	// $Number$ template, the time shift buffer of a stream can be unbounded.
+	maxLiveSegments = 10000
+)
+
+// UTCTiming schemes used to synchronize the clock with the server.
+const (
+	utcTimingHTTPXSDate = "urn:mpeg:dash:utc:http-xsdate:2014"
+	utcTimingHTTPISO    = "urn:mpeg:dash:utc:http-iso:2014"
+	utcTimingHTTPHead   = "urn:mpeg:dash:utc:http-head:2014"
+	utcTimingDirect     = "urn:mpeg:dash:utc:direct:2014"
+)
+
+// DownloadLiveFromMPDFile records a dynamic manifest until opts.Duration of
+// content is recorded, opts.Stop is closed or the stream ends, and muxes the
+// recording like a VOD download.
+// Static manifests are downloaded entirely.
+func DownloadLiveFromMPDFile(manifestURL, pathToUse, outFilename string, opts LiveOptions) error {
+	return DownloadJob(&WJob{
+		Type:     ManifestDL,
+		URL:      manifestURL,
+		DestPath: pathToUse,
+		Filename: outFilename,
+		Live:     &opts,
+	})
+}
+
+// isDynamic returns true for live manifests.
+func (m *manifest) isDynamic() bool {
+	return m.Type != nil && *m.Type == "dynamic"
+}
+
+// availabilityStartTime returns the parsed MPD@availabilityStartTime.
+func (m *manifest) availabilityStartTime() (time.Time, error) {
+	if m.AvailabilityStartTime == nil {
+		return time.Time{}, errors.New("dynamic mpd without availabilityStartTime")
+	}
+	return parseDateTime(*m.AvailabilityStartTime)
+}
+
+// durationAttr parses an optional xs:duration attribute, 0 means not set.
+func durationAttr(name string, value *string, log *slog.Logger) time.Duration {
+	if value == nil || *value == "" {
+		return 0
+	}
+	d, err := mpd.ParseDuration(*value)
+	if err != nil {
+		log.Warn("invalid duration attribute", "attribute", name, "value", *value, "err", err)
+		return 0
+	}
+	return d
+}
+
+// parseDateTime parses a xs:dateTime, a missing time zone means UTC.
+func parseDateTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date time %q", value)
+}
+
+// liveClock is the wall clock of the server, segments become available
+// based on it and not on the local clock.
+type liveClock struct {
+	offset time.Duration
+}
+
+func (c *liveClock) now() time.Time {
+	return time.Now().Add(c.offset)
+}
+
+// syncClock synchronizes the clock with the server using the UTCTiming of
+// the manifest, the local clock is used when it's not set or can't be used.
+func syncClock(ctx context.Context, client *http.Client, m *manifest, manifestURL *url.URL) *liveClock {
+	log := loggerFrom(ctx)
+	clock := &liveClock{}
+	timing := m.UTCTiming
+	if timing == nil || timing.SchemeIDURI == nil {
+		return clock
+	}
+	value := strings.TrimSpace(strPtrtoEmpty(timing.Value))
+
+	var serverTime, localTime time.Time
+	var err error
+	switch scheme := *timing.SchemeIDURI; scheme {
+	case utcTimingDirect:
+		localTime = time.Now()
+		serverTime, err = parseDateTime(value)
+	case utcTimingHTTPXSDate, utcTimingHTTPISO, utcTimingHTTPHead:
+		err = fmt.Errorf("no time server url")
+		// the value can list multiple servers
+		for _, serverURL := range strings.Fields(value) {
+			u := absBaseURL(manifestURL, []string{serverURL}).String()
+			serverTime, localTime, err = fetchServerTime(ctx, client, scheme, u)
+			if err == nil {
+				break
+			}
+		}
+	default:
+		log.Warn("UTCTiming scheme not supported, using the local clock", "scheme", scheme)
+		return clock
+	}
+	if err != nil {
+		log.Warn("failed to synchronize the clock, using the local clock", "url", value, "err", err)
+		return clock
+	}
+
+	clock.offset = serverTime.Sub(localTime)
+	log.Debug("server clock offset", "offset", clock.offset)
+	return clock
+}
+
+// fetchServerTime requests the time of a UTCTiming server and returns it
+// with the local time it corresponds to (half way through the request).
+func fetchServerTime(ctx context.Context, client *http.Client, scheme, serverURL string) (serverTime, localTime time.Time, err error) {
+	method := http.MethodGet
+	if scheme == utcTimingHTTPHead {
+		method = http.MethodHead
+	}
+	req, err := http.NewRequestWithContext(ctx, method, serverURL, nil)
+	if err != nil {
+		return serverTime, localTime, err
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return serverTime, localTime, err
+	}
+	defer resp.Body.Close()
+	localTime = start.Add(time.Since(start) / 2)
+	if resp.StatusCode != http.StatusOK {
+		return serverTime, localTime, fmt.Errorf("bad status: %s", resp.Status)
+	}
+
+	if scheme == utcTimingHTTPHead {
+		serverTime, err = http.ParseTime(resp.Header.Get("Date"))
+		return serverTime, localTime, err
+	}
+	body := make([]byte, 128)
+	n, _ := resp.Body.Read(body)
+	serverTime, err = parseDateTime(string(body[:n]))
+	return serverTime, localTime, err
+}
+
+// liveTrack is a track being recorded, it's identified across periods and
+// manifest refreshes by its track group.
+type liveTrack struct {
+	download *trackDownload
+	started  bool
+	// from is the wall clock time the recording of the track starts at
+	from time.Time
+	// recorded is the duration of the queued media segments
+	recorded time.Duration
+	seen     map[string]bool
+	// period is the selection of the period of the last queued segments
+	period *trackSelection
+}
+
+// done returns true once the requested duration is recorded.
+func (t *liveTrack) done(opts *LiveOptions) bool {
+	return opts.Duration > 0 && t.started && t.recorded >= opts.Duration
+}
+
+// queue queues the available segments of the selection the track didn't
+// record yet.
+func (t *liveTrack) queue(sel *trackSelection, segments []*Segment, periodStart time.Time, opts *LiveOptions) {
+	var inits, media []*Segment
+	for _, segment := range segments {
+		if segment.Init {
+			inits = append(inits, segment)
+		} else {
+			media = append(media, segment)
+		}
+	}
+	if len(media) == 0 {
+		return
+	}
+
+	if !t.started {
+		// the live edge is the latest available segment
+		if !opts.FromStart {
+			media = media[len(media)-1:]
+		}
+		t.from = periodStart.Add(media[0].Start)
+		t.started = true
+		t.download.log.Info("recording track", "content_type", t.download.cType, "representation", strPtrtoS(t.download.r.ID), "from", t.from.UTC().Format(time.RFC3339))
+	}
+
+	var newSegments []*Segment
+	for _, segment := range media {
+		if t.done(opts) {
+			break
+		}
+		key := segment.URL + "|" + segment.ByteRange
+		if t.seen[key] || periodStart.Add(segment.Start).Before(t.from) {
+			continue
+		}
+		t.seen[key] = true
+		t.recorded += segment.Duration
+		newSegments = append(newSegments, segment)
+	}
+	if len(newSegments) == 0 {
+		return
+	}
+
+	if t.period != nil && t.period.PeriodKey != sel.PeriodKey {
+		t.download.startPeriod(sel.continues(t.period))
+	}
+	t.period = sel
+	// the download skips the initialization segment it already queued for
+	// the current part
+	toQueue := append(inits, newSegments...)
+	t.download.log.Debug("queuing new segments", "segments", len(toQueue))
+	t.download.queue(sel.BaseURL, toQueue...)
+}
+
+// liveRecording is the state of a live recording job.
+type liveRecording struct {
+	opts        *LiveOptions
+	manifestURL *url.URL
+	clock       *liveClock
+	periods     *periodFilter
+	hosts       *hostHealth
+	urls        *urlRewriter
+	signing     *urlSigning
+	client      *http.Client
+	retry       *RetryOptions
+	// sizeTolerance is the Options.SegmentSizeTolerance of the job
+	sizeTolerance float64
+	workspace     *workspace
+	filter        *trackFilter
+	segments      chan<- *WJob
+	ctx           context.Context
+	events        *jobEvents
+	log           *slog.Logger
+	groups        *trackGroups
+	tracks        map[*trackGroup]*liveTrack
+}
+
+// recordLive records a dynamic manifest, refreshing it as often as
+// MPD@minimumUpdatePeriod allows, and muxes the recorded tracks.
+func (w *Worker) recordLive(job *WJob, m *manifest, manifestURL *url.URL, periods *periodFilter) {
+	opts := job.Live
+	if opts == nil {
+		opts = &LiveOptions{}
+	}
+	// the live window moved since the previous run
+	job.workspace.reset()
+	rec := &liveRecording{
+		opts:          opts,
+		manifestURL:   manifestURL,
+		clock:         syncClock(job.ctx, job.client, m, manifestURL),
+		periods:       periods,
+		hosts:         job.hosts,
+		urls:          job.urls,
+		signing:       job.signing,
+		client:        job.client,
+		retry:         job.retry,
+		sizeTolerance: job.grabber.opts.SegmentSizeTolerance,
+		workspace:     job.workspace,
+		filter:        job.grabber.filter,
+		segments:      job.grabber.segments,
+		ctx:           job.ctx,
+		events:        job.events,
+		log:           job.log,
+		groups:        newTrackGroups(job.log),
+		tracks:        map[*trackGroup]*liveTrack{},
+	}
+	job.log.Info("recording the live stream", "url", manifestURL.String())
+
+	lastRefresh := time.Now()
+	for {
+		ended := !m.isDynamic()
+		if err := rec.queueAvailableSegments(m, ended); err != nil {
+			job.Err = err
+			job.log.Error("failed to queue the live segments", "err", job.Err)
+			break
+		}
+		if ended {
+			job.log.Info("live stream ended")
+			break
+		}
+		if rec.done() {
+			job.log.Info("requested duration recorded", "duration", opts.Duration)
+			break
+		}
+
+		stopped := false
+		select {
+		case <-opts.Stop:
+			stopped = true
+		case <-job.ctx.Done():
+			// the recording is aborted, not muxed
+			job.Err = job.ctx.Err()
+		case <-time.After(liveTick):
+		}
+		if stopped {
+			job.log.Info("recording stopped")
+			break
+		}
+		if job.Err != nil {
+			break
+		}
+
+		// without minimumUpdatePeriod, the manifest doesn't change
+		if m.MinimumUpdatePeriod == nil {
+			continue
+		}
+		refresh := durationAttr("minimumUpdatePeriod", m.MinimumUpdatePeriod, job.log)
+		if refresh < minLiveRefresh {
+			refresh = minLiveRefresh
+		}
+		if time.Since(lastRefresh) < refresh {
+			continue
+		}
+		lastRefresh = time.Now()
+		refreshed, err := refreshManifest(job.ctx, job.client, m, manifestURL)
+		if err != nil {
+			// keep using the previous version, the next refresh might work
+			job.log.Warn("failed to refresh the manifest", "err", err)
+			continue
+		}
+		m = refreshed
+	}
+
+	tracks := &outputTracks{}
+	for _, group := range rec.groups.groups {
+		liveTrack, ok := rec.tracks[group]
+		if !ok || !liveTrack.started {
+			continue
+		}
+		track, err := liveTrack.download.assemble()
+		if err != nil {
+			job.Err = err
+			job.log.Error("failed to assemble the live track", "err", job.Err)
+			continue
+		}
+		tracks.add(track)
+	}
+	if job.Err != nil {
+		// a partial recording isn't muxed
+		return
+	}
+	if tracks.empty() {
+		job.Err = fmt.Errorf("no live segments recorded - %w", ErrMissingSegments)
+		return
+	}
+
+	muxTracks(job, job.Filename, tracks)
+	if job.Err == nil {
+		job.workspace.remove()
+	}
+}
+
+// refreshManifest fetches the latest version of a live manifest, using
+// MPD.Location if set.
+func refreshManifest(ctx context.Context, client *http.Client, m *manifest, manifestURL *url.URL) (*manifest, error) {
+	refreshURL := manifestURL
+	if m.Location != "" {
+		refreshURL = absBaseURL(manifestURL, []string{strings.TrimSpace(m.Location)})
+	}
+	loggerFrom(ctx).Debug("refreshing the manifest", "url", refreshURL.String())
+	data, err := fetchRange(ctx, client, refreshURL.String(), "")
+	if err != nil {
+		return nil, err
+	}
+	return parseManifest(ctx, client, data, refreshURL)
+}
+
+// done returns true once all the tracks recorded the requested duration.
+func (rec *liveRecording) done() bool {
+	if rec.opts.Duration <= 0 || len(rec.tracks) == 0 {
+		return false
+	}
+	for _, track := range rec.tracks {
+		if !track.done(rec.opts) {
+			return false
+		}
+	}
+	return true
+}
+
+// queueAvailableSegments queues the segments that became available since
+// the last call. Once the stream ended, the remaining segments are queued.
+func (rec *liveRecording) queueAvailableSegments(m *manifest, ended bool) error {
+	ast, err := m.availabilityStartTime()
+	if err != nil {
+		return &ManifestError{Kind: ErrManifestParse, URL: rec.manifestURL.String(), Err: err}
+	}
+	now := rec.clock.now()
+
+	for _, sel := range rec.periods.filter(m, rec.manifestURL, selectTracks(m, rec.manifestURL, rec.filter, rec.log)) {
+		cType, ok := contentTypeFor(sel.ContentType)
+		if !ok {
+			continue
+		}
+		periodStart := ast.Add(m.periodStart(sel.Period))
+		periodDuration := m.periodDuration(sel.Period)
+
+		// segments are available once they are entirely produced
+		elapsed := now.Sub(periodStart)
+		if periodDuration > 0 && (ended || elapsed > periodDuration) {
+			elapsed = periodDuration
+		}
+		if elapsed <= 0 {
+			// the period didn't start yet
+			continue
+		}
+		windowStart := liveWindowStart(m, now.Sub(periodStart), ended, rec.opts.FromStart, rec.log)
+		segments, err := liveSegments(m, sel, windowStart, elapsed, rec.log)
+		if err != nil {
+			return segmentListingError(rec.manifestURL.String(), fmt.Errorf("failed to list the live segments of representation %s - %w", strPtrtoS(sel.Representation.ID), err))
+		}
+
+		rec.urls.applySegments(segments)
+		addSegmentMirrors(segments, sel)
+		rec.hosts.register(sel.BaseURLs)
+		rec.signing.register(sel)
+
+		// periods are stitched like VOD
+		group := rec.groups.add(sel)
+		track, ok := rec.tracks[group]
+		if !ok {
+			track = &liveTrack{
+				download: newTrackDownload(sel.Representation, cType, sel.BaseURL),
+				seen:     map[string]bool{},
+			}
+			track.download.hosts = rec.hosts
+			track.download.signing = rec.signing
+			track.download.client = rec.client
+			track.download.retry = rec.retry
+			track.download.sizeTolerance = rec.sizeTolerance
+			track.download.workspace = rec.workspace
+			track.download.segments = rec.segments
+			track.download.ctx = rec.ctx
+			track.download.events = rec.events
+			track.download.info = newTrackInfo([]*trackSelection{sel})
+			track.download.log = rec.log.With("track", track.download.info.ID)
+			rec.tracks[group] = track
+		}
+		track.queue(sel, segments, periodStart, rec.opts)
+	}
+	return nil
+}
+
+// liveWindowStart returns the start (relative to the period start) of the
+// segments to list, sinceStart is the time elapsed since the period start.
+// The segments stay available for the duration of the time shift buffer,
+// only the ones close to the live edge are listed when the recording doesn't
+// start from the beginning of the buffer.
+func liveWindowStart(m *manifest, sinceStart time.Duration, ended, fromStart bool, log *slog.Logger) time.Duration {
+	if ended {
+		return 0
+	}
+	var windowStart time.Duration
+	if timeShiftBufferDepth := durationAttr("timeShiftBufferDepth", m.TimeShiftBufferDepth, log); timeShiftBufferDepth > 0 {
+		windowStart = sinceStart - timeShiftBufferDepth
+	}
+	if !fromStart {
+		window := liveEdgeWindow
+		if m.SuggestedPresentationDelay != nil && time.Duration(*m.SuggestedPresentationDelay) > window {
+			window = time.Duration(*m.SuggestedPresentationDelay)
+		}
+		if edge := sinceStart - window; edge > windowStart {
+			windowStart = edge
+		}
+	}
+	return windowStart
+}
+
+// liveSegments returns the segments of the selected representation available
+// between windowStart and elapsed (relative to the start of the period).
+func liveSegments(m *manifest, sel *trackSelection, windowStart, elapsed time.Duration, log *slog.Logger) ([]*Segment, error) {
+	r := sel.Representation
+	info := resolveSegmentInfo(m, sel.Period, r.AdaptationSet, r)
+
+	var segments []*Segment
+	var err error
+	switch info.Addressing {
+	case addressingTemplate:
+		if info.Template.SegmentTimeline == nil && int64PtrToI(info.Template.Duration) > 0 {
+			// the number of segments grows forever, only the ones in the
+			// window are listed.
+			segments, err = liveNumberedSegments(info, m.periodDuration(sel.Period), sel.BaseURL, r, windowStart, elapsed, log)
+		} else {
+			segments, err = templatedSegments(info, elapsed, sel.BaseURL, r, log)
+		}
+	case addressingList:
+		segments, err = listSegments(info, elapsed, sel.BaseURL, r, log)
+	default:
+		return nil, fmt.Errorf("%s addressing not supported for live streams - %w", info.Addressing, ErrUnsupportedManifest)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	available := segments[:0]
+	for _, segment := range segments {
+		// segments without timing information can't be filtered
+		if segment.Init || segment.Duration == 0 {
+			available = append(available, segment)
+			continue
+		}
+		if segment.End() > elapsed || segment.End() < windowStart {
+			continue
+		}
+		available = append(available, segment)
+	}
+	return available, nil
+}
+
+// liveNumberedSegments lists the segments of a $Number$ template using
+// @duration that end between windowStart and elapsed, the initialization
+// segment first.
+func liveNumberedSegments(info *segmentInfo, periodDuration time.Duration, baseURL *url.URL, r *mpd.Representation, windowStart, elapsed time.Duration, log *slog.Logger) ([]*Segment, error) {
+	template := info.Template
+
+	// the initialization segment
+	initTemplate := *template
+	initTemplate.Media = nil
+	initInfo := *info
+	initInfo.Template = &initTemplate
+	segments, err := templatedSegments(&initInfo, periodDuration, baseURL, r, log)
+	if err != nil || template.Media == nil {
+		return segments, err
+	}
+
+	media, err := parseTemplate(*template.Media)
+	if err != nil {
+		return nil, err
+	}
+	if media.uses(identTime) {
+		return nil, fmt.Errorf("invalid template %q: $Time$ requires a SegmentTimeline", media.raw)
+	}
+
+	timescale := uint64(1)
+	if template.Timescale != nil && *template.Timescale > 0 {
+		timescale = uint64(*template.Timescale)
+	}
+	var pto uint64
+	if template.PresentationTimeOffset != nil {
+		pto = *template.PresentationTimeOffset
+	}
+	startNumber := int64(1)
+	if template.StartNumber != nil {
+		startNumber = *template.StartNumber
+	}
+	duration := uint64(*template.Duration)
+	segDuration := timescaleDuration(int64(duration), timescale)
+	if segDuration <= 0 {
+		return nil, fmt.Errorf("invalid SegmentTemplate duration %d", duration)
+	}
+
+	var first int64
+	if windowStart > 0 {
+		first = int64(windowStart / segDuration)
+	}
+	// the last segment can be partially produced, it gets filtered out
+	last := int64((elapsed + segDuration - 1) / segDuration)
+	if endNumber := info.TemplateExt.EndNumber; endNumber != nil && *endNumber-startNumber+1 < last {
+		last = *endNumber - startNumber + 1
+	}
+	if last-first > maxLiveSegments {
+		log.Debug("capping the listed live segments", "segments", last-first, "max", maxLiveSegments)
+		first = last - maxLiveSegments
+	}
+
+	vars := representationVars(r)
+	for i := first; i < last; i++ {
+		vars.Number = startNumber + i
+		segment := &Segment{
+			URL:       absBaseURL(baseURL, []string{media.expand(vars)}).String(),
+			Number:    vars.Number,
+			Time:      pto + uint64(i)*duration,
+			Timescale: timescale,
+			Start:     timescaleDuration(int64(uint64(i)*duration), timescale),
+			Duration:  segDuration,
+		}
+		// the last segment stops at the end of the period
+		if periodDuration > 0 && segment.End() > periodDuration {
+			segment.Duration = periodDuration - segment.Start
+		}
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
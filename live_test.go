@@ -0,0 +1,87 @@
+package mpdgrabber
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestLiveSegmentsWithoutTimeShiftBufferDepth(t *testing.T) {
+	// the stream started long ago and doesn't announce its time shift buffer
+	m, err := readManifest([]byte(`<?xml version="1.0"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="dynamic" availabilityStartTime="1970-01-01T00:00:00Z" minimumUpdatePeriod="PT2S">
+  <Period id="0" start="PT0S">
+    <AdaptationSet mimeType="video/mp4">
+      <SegmentTemplate initialization="init.mp4" media="seg_$Number$.m4s" duration="2" timescale="1" startNumber="1"/>
+      <Representation id="v" bandwidth="1000"/>
+    </AdaptationSet>
+  </Period>
+</MPD>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestURL, _ := url.Parse("https://example.com/live/manifest.mpd")
+	selections := selectTracks(m, manifestURL, newTrackFilter(nil, nil), discardLogger)
+	if len(selections) != 1 {
+		t.Fatalf("got %d selections, want 1", len(selections))
+	}
+	sinceStart := time.Since(time.Unix(0, 0))
+
+	tests := []struct {
+		name      string
+		fromStart bool
+		// max is the maximum number of media segments listed
+		max int
+	}{
+		{"live edge", false, int(liveEdgeWindow/(2*time.Second)) + 1},
+		{"from start", true, maxLiveSegments},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			windowStart := liveWindowStart(m, sinceStart, false, tt.fromStart, discardLogger)
+			segments, err := liveSegments(m, selections[0], windowStart, sinceStart, discardLogger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var media []*Segment
+			for _, segment := range segments {
+				if !segment.Init {
+					media = append(media, segment)
+				}
+			}
+			if len(media) == 0 || len(media) > tt.max {
+				t.Fatalf("listed %d segments, want between 1 and %d", len(media), tt.max)
+			}
+			// the latest available segment is listed
+			if last := media[len(media)-1]; sinceStart-last.End() > 2*time.Second {
+				t.Errorf("the last listed segment ends %s before the live edge", sinceStart-last.End())
+			}
+		})
+	}
+}
+
+func TestLiveWindowStart(t *testing.T) {
+	m, err := readManifest([]byte(`<?xml version="1.0"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="dynamic" availabilityStartTime="2024-01-01T00:00:00Z" timeShiftBufferDepth="PT10M" suggestedPresentationDelay="PT2M">
+  <Period id="0" start="PT0S"/>
+</MPD>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sinceStart := time.Hour
+	tests := []struct {
+		name      string
+		ended     bool
+		fromStart bool
+		want      time.Duration
+	}{
+		{"live edge minus the suggested delay", false, false, sinceStart - 2*time.Minute},
+		{"time shift buffer", false, true, sinceStart - 10*time.Minute},
+		{"ended", true, false, 0},
+	}
+	for _, tt := range tests {
+		if got := liveWindowStart(m, sinceStart, tt.ended, tt.fromStart, discardLogger); got != tt.want {
+			t.Errorf("%s: liveWindowStart() = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
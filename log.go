@@ -0,0 +1,53 @@
+package mpdgrabber
+
+import (
+	"context"
+	"log/slog"
+	"os"
+)
+
+var (
+	// Logger receives the logs of the package and of the grabbers without
+	// their own logger (Options.Logger), slog.Default() is used if nil.
+	Logger *slog.Logger
+	// Debug writes the debug logs to stderr when Logger isn't set.
+	Debug = false
+)
+
+var debugLogger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+// packageLogger returns the logger of the package.
+func packageLogger() *slog.Logger {
+	if Logger != nil {
+		return Logger
+	}
+	if Debug {
+		return debugLogger
+	}
+	return slog.Default()
+}
+
+type loggerKey struct{}
+
+// withLogger returns a context carrying the logger of a job, the functions
+// called with the context log through it.
+func withLogger(ctx context.Context, log *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, log)
+}
+
+// loggerFrom returns the logger of the job of the context, the logger of the
+// package if none.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if ctx != nil {
+		if log, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+			return log
+		}
+	}
+	return packageLogger()
+}
+
+// debugEnabled reports if the debug logs are enabled, to skip building
+// verbose ones.
+func debugEnabled(log *slog.Logger) bool {
+	return log.Enabled(context.Background(), slog.LevelDebug)
+}
@@ -0,0 +1,193 @@
+package mpdgrabber
+
+import (
+	"bytes"
+	"encoding/xml"
+	"time"
+
+	"github.com/mattetti/go-dash/mpd"
+)
+
+// manifest wraps the parsed MPD with the extra attributes go-dash doesn't
+// decode (endNumber or the BaseURL attributes for instance).
+type manifest struct {
+	*mpd.MPD
+	ext *mpdExt
+
+	templates map[*mpd.SegmentTemplate]*segmentTemplateExt
+	// baseURLs are the BaseURL elements with their attributes, by owner
+	// (*mpd.MPD, *mpd.Period, *mpd.AdaptationSet or *mpd.Representation)
+	baseURLs map[interface{}][]*baseURLExt
+}
+
+// mpdExt is a second, lighter pass over the MPD document that only picks up
+// the attributes missing from the go-dash structs. The elements are matched
+// with the go-dash ones by their position in the document.
+type mpdExt struct {
+	BaseURLs        []*baseURLExt       `xml:"BaseURL"`
+	ContentSteering *contentSteeringExt `xml:"ContentSteering"`
+	Periods         []*periodExt        `xml:"Period"`
+}
+
+type periodExt struct {
+	BaseURLs        []*baseURLExt       `xml:"BaseURL"`
+	SegmentTemplate *segmentTemplateExt `xml:"SegmentTemplate"`
+	AdaptationSets  []*adaptationSetExt `xml:"AdaptationSet"`
+}
+
+type adaptationSetExt struct {
+	BaseURLs        []*baseURLExt        `xml:"BaseURL"`
+	SegmentTemplate *segmentTemplateExt  `xml:"SegmentTemplate"`
+	Representations []*representationExt `xml:"Representation"`
+}
+
+type representationExt struct {
+	BaseURLs        []*baseURLExt       `xml:"BaseURL"`
+	SegmentTemplate *segmentTemplateExt `xml:"SegmentTemplate"`
+}
+
+// baseURLExt is a BaseURL element with its attributes, the DVB priority and
+// weight attributes are matched whatever their namespace prefix.
+type baseURLExt struct {
+	Value           string  `xml:",chardata"`
+	ServiceLocation *string `xml:"serviceLocation,attr"`
+	Priority        *int    `xml:"priority,attr"`
+	Weight          *int    `xml:"weight,attr"`
+}
+
+// contentSteeringExt is the ContentSteering element pointing at the
+// steering server.
+type contentSteeringExt struct {
+	URL                    string  `xml:",chardata"`
+	DefaultServiceLocation *string `xml:"defaultServiceLocation,attr"`
+	QueryBeforeStart       *bool   `xml:"queryBeforeStart,attr"`
+}
+
+type segmentTemplateExt struct {
+	EndNumber          *int64  `xml:"endNumber,attr"`
+	Index              *string `xml:"index,attr"`
+	BitstreamSwitching *string `xml:"bitstreamSwitching,attr"`
+}
+
+// readManifest parses the raw MPD data.
+func readManifest(data []byte) (*manifest, error) {
+	mpdData, err := mpd.Read(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	ext := &mpdExt{}
+	if err := xml.Unmarshal(data, ext); err != nil {
+		return nil, err
+	}
+
+	m := &manifest{
+		MPD:       mpdData,
+		ext:       ext,
+		templates: map[*mpd.SegmentTemplate]*segmentTemplateExt{},
+		baseURLs:  map[interface{}][]*baseURLExt{},
+	}
+	m.pairExtensions()
+	return m, nil
+}
+
+// pairExtensions walks the go-dash tree and the extension tree side by side.
+func (m *manifest) pairExtensions() {
+	m.baseURLs[m.MPD] = m.ext.BaseURLs
+	for i, period := range m.Periods {
+		if i >= len(m.ext.Periods) {
+			return
+		}
+		pExt := m.ext.Periods[i]
+		m.pairTemplate(period.SegmentTemplate, pExt.SegmentTemplate)
+		m.baseURLs[period] = pExt.BaseURLs
+		for j, as := range period.AdaptationSets {
+			if j >= len(pExt.AdaptationSets) {
+				break
+			}
+			asExt := pExt.AdaptationSets[j]
+			m.pairTemplate(as.SegmentTemplate, asExt.SegmentTemplate)
+			m.baseURLs[as] = asExt.BaseURLs
+			for k, r := range as.Representations {
+				if k >= len(asExt.Representations) {
+					break
+				}
+				m.pairTemplate(r.SegmentTemplate, asExt.Representations[k].SegmentTemplate)
+				m.baseURLs[r] = asExt.Representations[k].BaseURLs
+			}
+		}
+	}
+}
+
+func (m *manifest) pairTemplate(t *mpd.SegmentTemplate, ext *segmentTemplateExt) {
+	if t == nil || ext == nil {
+		return
+	}
+	m.templates[t] = ext
+}
+
+// templateExt returns the extra attributes of the passed template, never nil.
+func (m *manifest) templateExt(t *mpd.SegmentTemplate) *segmentTemplateExt {
+	if m != nil {
+		if ext, ok := m.templates[t]; ok {
+			return ext
+		}
+	}
+	return &segmentTemplateExt{}
+}
+
+// mediaPresentationDuration returns the parsed MPD@mediaPresentationDuration
+// or 0 if not set.
+func (m *manifest) mediaPresentationDuration() time.Duration {
+	if m == nil || m.MediaPresentationDuration == nil {
+		return 0
+	}
+	d, err := mpd.ParseDuration(*m.MediaPresentationDuration)
+	if err != nil {
+		packageLogger().Debug("invalid mediaPresentationDuration", "value", *m.MediaPresentationDuration, "err", err)
+		return 0
+	}
+	return d
+}
+
+// periodStart returns the start of the period, relative to the start of the
+// presentation.
+func (m *manifest) periodStart(period *mpd.Period) time.Duration {
+	var start time.Duration
+	for _, p := range m.Periods {
+		if p.Start != nil {
+			start = time.Duration(*p.Start)
+		}
+		if p == period {
+			return start
+		}
+		// without explicit start, a period starts when the previous one ends
+		start += time.Duration(p.Duration)
+	}
+	return start
+}
+
+// periodDuration returns the duration of the passed period using
+// Period@duration, the start of the next period or the
+// MPD@mediaPresentationDuration, in that order.
+func (m *manifest) periodDuration(period *mpd.Period) time.Duration {
+	if period == nil {
+		return m.mediaPresentationDuration()
+	}
+	if period.Duration > 0 {
+		return time.Duration(period.Duration)
+	}
+	start := m.periodStart(period)
+	for i, p := range m.Periods {
+		if p != period {
+			continue
+		}
+		if i+1 < len(m.Periods) && m.Periods[i+1].Start != nil {
+			return time.Duration(*m.Periods[i+1].Start) - start
+		}
+		break
+	}
+	if total := m.mediaPresentationDuration(); total > start {
+		return total - start
+	}
+	return 0
+}
@@ -1,22 +1,24 @@
 package mpdgrabber
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math"
 	"mime"
 	"net/http"
 	"net/url"
 	"os"
-	"strconv"
+	"path"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/mattetti/go-dash/mpd"
 )
 
-var Debug = false
-var Logger = log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lshortfile)
-
 const UnknownString = "unknown"
 
 type ContentType int
@@ -40,53 +42,164 @@ func (c ContentType) String() string {
 	}
 }
 
-func templatedSegments(baseURL *url.URL, representation *mpd.Representation) (segmentUrls []string) {
+func templatedSegments(info *segmentInfo, periodDuration time.Duration, baseURL *url.URL, representation *mpd.Representation, log *slog.Logger) (segments []*Segment, err error) {
 	if representation == nil {
-		if Debug {
-			fmt.Println("no representation to look for templated segments")
-		}
+		log.Debug("no representation to look for templated segments")
 		return
 	}
-	// I don't think you have 2 templates but the mpd format is bonkers... so maybe?
-	var template *mpd.SegmentTemplate
-	if representation.AdaptationSet != nil && representation.AdaptationSet.SegmentTemplate != nil {
-		template = representation.AdaptationSet.SegmentTemplate
-		if Debug {
-			fmt.Println("->using AdaptationSet.SegmentTemplate")
-		}
-	} else {
-		template = representation.SegmentTemplate
-		if Debug {
-			fmt.Println("->using Representation.SegmentTemplate")
+	// the template is the merge of the Period, AdaptationSet and Representation templates
+	if info == nil || info.Template == nil {
+		log.Debug("no SegmentTemplate found", "representation", strPtrtoS(representation.ID))
+		return
+	}
+	template := info.Template
+	ext := info.TemplateExt
+
+	// the index template isn't used to download the media but we still want
+	// to report broken manifests
+	if ext.Index != nil {
+		if _, err = parseTemplate(*ext.Index); err != nil {
+			return nil, err
 		}
 	}
-	if template == nil {
-		if Debug {
-			fmt.Println("no SegmentTemplate found")
+
+	// without initialization template, the bitstream switching segment is
+	// used to initialize the stream.
+	initTemplate := template.Initialization
+	if initTemplate == nil {
+		initTemplate = ext.BitstreamSwitching
+	}
+	if initTemplate != nil {
+		initURL, err := initializationURL(*initTemplate, representation)
+		if err != nil {
+			return nil, err
 		}
+		segments = append(segments, &Segment{URL: initURL, Init: true})
+		log.Debug("templated initialization url", "representation", strPtrtoS(representation.ID), "url", initURL)
+	}
+
+	mediaSegments, err := templateSubstitution(template.Media, template, ext, representation, periodDuration, log)
+	if err != nil {
+		return nil, err
+	}
+	segments = append(segments, mediaSegments...)
+	log.Debug("templated segments found", "representation", strPtrtoS(representation.ID), "segments", len(segments))
+	for _, segment := range segments {
+		segment.URL = absBaseURL(baseURL, []string{segment.URL}).String()
+	}
+
+	return segments, nil
+}
+
+// listSegments returns the segments of a SegmentList representation, the
+// initialization segment first if there is one.
+func listSegments(info *segmentInfo, periodDuration time.Duration, baseURL *url.URL, representation *mpd.Representation, log *slog.Logger) (segments []*Segment, err error) {
+	if info == nil || info.List == nil {
+		log.Debug("no SegmentList found")
 		return
 	}
+	list := info.List
+
+	// without Initialization, the bitstream switching segment is used to
+	// initialize the stream.
+	initURL := list.Initialization
+	if initURL == nil {
+		initURL = list.BitstreamSwitching
+	}
+	if initURL != nil {
+		segments = append(segments, &Segment{
+			URL:       resolveSegmentURL(baseURL, initURL.SourceURL),
+			ByteRange: strPtrtoEmpty(initURL.Range),
+			Init:      true,
+		})
+		log.Debug("SegmentList initialization url", "url", segments[0].URL, "range", segments[0].ByteRange)
+	}
 
-	segmentUrls = templateSubstitution(template.Initialization, representation)
-	if Debug && len(segmentUrls) > 0 {
-		fmt.Printf("templated Initialization url: %s\n", segmentUrls[0])
+	timescale := uint64(1)
+	if list.Timescale != nil && *list.Timescale > 0 {
+		timescale = uint64(*list.Timescale)
+	}
+	var pto uint64
+	if list.PresentationTimeOffset != nil {
+		pto = *list.PresentationTimeOffset
 	}
-	segmentUrls = append(segmentUrls, templateSubstitution(template.Media, representation)...)
-	if Debug {
-		fmt.Printf("Found templated segments %d\n", len(segmentUrls))
+	number := int64(1)
+	if list.StartNumber != nil {
+		number = int64(*list.StartNumber)
 	}
-	for i, segmentURL := range segmentUrls {
-		segmentUrls[i] = absBaseURL(baseURL, []string{segmentURL}).String()
+	var periodEnd uint64
+	if periodDuration > 0 {
+		periodEnd = pto + durationToTimescale(periodDuration, timescale)
 	}
+	timeline := expandTimeline(list.SegmentTimeline, periodEnd, log)
+	duration := uint64(uint32PtrToI(list.Duration))
 
-	return segmentUrls
+	for i, segURL := range list.SegmentURLs {
+		segment := &Segment{
+			URL:       resolveSegmentURL(baseURL, segURL.Media),
+			ByteRange: strPtrtoEmpty(segURL.MediaRange),
+			Number:    number + int64(i),
+			Timescale: timescale,
+		}
+		// the timing comes from the SegmentTimeline or @duration
+		if i < len(timeline) {
+			segment.Time = timeline[i].time
+			segment.Start = timescaleDuration(int64(timeline[i].time)-int64(pto), timescale)
+			segment.Duration = timescaleDuration(int64(timeline[i].duration), timescale)
+		} else if duration > 0 {
+			segment.Time = pto + uint64(i)*duration
+			segment.Start = timescaleDuration(int64(uint64(i)*duration), timescale)
+			segment.Duration = timescaleDuration(int64(duration), timescale)
+		}
+		segments = append(segments, segment)
+	}
+	log.Debug("listed segments found", "segments", len(segments))
+
+	return segments, nil
 }
 
-func templateSubstitution(templateStr *string, representation *mpd.Representation) (urls []string) {
+// resolveSegmentURL resolves a (potentially relative) segment url against
+// the base url. Without url, the segment is in the resource pointed by the
+// base url itself.
+func resolveSegmentURL(baseURL *url.URL, segURL *string) string {
+	if segURL == nil || *segURL == "" {
+		return baseURL.String()
+	}
+	return absBaseURL(baseURL, []string{*segURL}).String()
+}
+
+// initializationURL expands an @initialization or @bitstreamSwitching
+// template, neither can reference a segment number or time.
+func initializationURL(templateStr string, representation *mpd.Representation) (string, error) {
+	tmpl, err := parseTemplate(templateStr)
+	if err != nil {
+		return "", err
+	}
+	if tmpl.uses(identNumber) || tmpl.uses(identTime) || tmpl.uses(identSubNumber) {
+		return "", fmt.Errorf("invalid template %q: initialization templates can't use $Number$, $Time$ or $SubNumber$", templateStr)
+	}
+	return tmpl.expand(representationVars(representation)), nil
+}
+
+// representationVars returns the template variables shared by all the
+// segments of a representation.
+func representationVars(representation *mpd.Representation) templateVars {
+	return templateVars{
+		RepresentationID: strPtrtoS(representation.ID),
+		Bandwidth:        int64(int64PtrToI(representation.Bandwidth)),
+	}
+}
+
+// templateSubstitution expands a @media template into the list of segments
+// it addresses, using the SegmentTimeline if present or @duration otherwise.
+func templateSubstitution(templateStr *string, segTemplate *mpd.SegmentTemplate, ext *segmentTemplateExt, representation *mpd.Representation, periodDuration time.Duration, log *slog.Logger) (segments []*Segment, err error) {
 	if templateStr == nil {
-		return urls
+		return segments, nil
+	}
+	template, err := parseTemplate(*templateStr)
+	if err != nil {
+		return nil, err
 	}
-	template := *templateStr
 
 	/*
 		$identifier$	Substitution parameter
@@ -95,70 +208,126 @@ func templateSubstitution(templateStr *string, representation *mpd.Representatio
 		$Number$	The player substitutes this identifier with the number of the corresponding Segment.
 		$Bandwidth$	The player substitutes this identifier with the value of Representation@bandwidth attribute value.
 		$Time$	The player substitutes this identifier with the value of the SegmentTimeline@t attribute for the Segment. You can use either $Number$ or $Time$, but not both at the same time.
+		$SubNumber$	The player substitutes this identifier with the number of the subsegment (only used with segment sequences).
+		$<Identifier>%0[width]d$	Number, Bandwidth, Time and SubNumber can be zero padded using a printf like format tag.
 	*/
 
-	if strings.Contains(template, "$RepresentationID$") {
-		template = strings.Replace(template, "$RepresentationID$", strPtrtoS(representation.ID), -1)
+	vars := representationVars(representation)
+	startNumber := 1
+	if segTemplate.StartNumber != nil {
+		startNumber = int64PtrToI(segTemplate.StartNumber)
+	}
+	vars.Number = int64(startNumber)
+	timescale := uint64(1)
+	if segTemplate.Timescale != nil && *segTemplate.Timescale > 0 {
+		timescale = uint64(*segTemplate.Timescale)
+	}
+	var pto uint64
+	if segTemplate.PresentationTimeOffset != nil {
+		pto = *segTemplate.PresentationTimeOffset
 	}
 
 	// Time-Based SegmentTemplate
 	// $Time$ identifier, which will be substituted with the value of the t attribute from the SegmentTimeline.
-	if strings.Contains(template, "$Time$") {
-		if Debug {
-			fmt.Println("\t-> Time-based SegmentTemplate")
-		}
-		var segTemplate *mpd.SegmentTemplate
-		if representation.AdaptationSet != nil && representation.AdaptationSet.SegmentTemplate != nil {
-			segTemplate = representation.AdaptationSet.SegmentTemplate
-		} else {
-			segTemplate = representation.SegmentTemplate
-		}
+	if template.uses(identTime) || template.uses(identNumber) {
+		log.Debug("SegmentTemplate", "time_based", template.uses(identTime), "timeline", segTemplate.SegmentTimeline != nil)
 
 		// segment timeline
 		if segTemplate.SegmentTimeline != nil {
-			if Debug {
-				fmt.Println("\t-> Segment timeline found")
-			}
 
 			/* example
-					<S t="0" d="96256" r="2" />
-					<S d="95232" />
-					<S d="96256" r="2" />
-			    <S d="95232" />
+			<S t="0" d="96256" r="2" />
+			<S d="95232" />
+			<S d="96256" r="-1" />
 			*/
 
-			currentT := 0
-			duration := 0
-
-			for _, tlSeg := range segTemplate.SegmentTimeline.Segments {
-				if tlSeg.StartTime != nil {
-					currentT = uint64PtrToI(tlSeg.StartTime)
-				}
-				duration = int(tlSeg.Duration)
-				url := strings.Replace(template, "$Time$", strconv.Itoa(currentT), -1)
-				urls = append(urls, url)
-				currentT += duration
-
-				// repeat count if present
-				if tlSeg.RepeatCount != nil {
-					repeat := intPtrToI(tlSeg.RepeatCount)
-					for i := 0; i < repeat; i++ {
-						url := strings.Replace(template, "$Time$", strconv.Itoa(currentT), -1)
-						urls = append(urls, url)
-						currentT += duration
-					}
-				}
+			var periodEnd uint64
+			if periodDuration > 0 {
+				periodEnd = pto + durationToTimescale(periodDuration, timescale)
+			}
+			for _, entry := range expandTimeline(segTemplate.SegmentTimeline, periodEnd, log) {
+				vars.Time = entry.time
+				segments = append(segments, &Segment{
+					URL:       template.expand(vars),
+					Number:    vars.Number,
+					Time:      entry.time,
+					Timescale: timescale,
+					Start:     timescaleDuration(int64(entry.time)-int64(pto), timescale),
+					Duration:  timescaleDuration(int64(entry.duration), timescale),
+				})
+				vars.Number++
 			}
+			return segments, nil
+		}
 
+		if template.uses(identTime) {
+			return nil, fmt.Errorf("invalid template %q: $Time$ requires a SegmentTimeline", template.raw)
 		}
 
-	} else if strings.Contains(template, "$Number$") {
+		// Number-Based SegmentTemplate
+		// $Number$ is substituted with the segment number, starting at @startNumber (1 by default)
+		nbrSegments := numberOfSegments(segTemplate, ext, startNumber, periodDuration, log)
+		log.Debug("numbered segments", "segments", nbrSegments, "start_number", startNumber)
+		duration := uint64(int64PtrToI(segTemplate.Duration))
+		for i := 0; i < nbrSegments; i++ {
+			segment := &Segment{
+				URL:       template.expand(vars),
+				Number:    vars.Number,
+				Time:      pto + uint64(i)*duration,
+				Timescale: timescale,
+				Start:     timescaleDuration(int64(uint64(i)*duration), timescale),
+				Duration:  timescaleDuration(int64(duration), timescale),
+			}
+			// the last segment stops at the end of the period
+			if periodDuration > 0 && segment.End() > periodDuration {
+				segment.Duration = periodDuration - segment.Start
+			}
+			segments = append(segments, segment)
+			vars.Number++
+		}
 
 	} else {
-		urls = append(urls, template)
+		segments = append(segments, &Segment{
+			URL:       template.expand(vars),
+			Number:    vars.Number,
+			Timescale: timescale,
+			Duration:  periodDuration,
+		})
+	}
+
+	return segments, nil
+}
+
+// numberOfSegments returns the number of segments described by a template
+// using @duration (without SegmentTimeline). @endNumber takes precedence,
+// otherwise the count is derived from the duration of the period.
+func numberOfSegments(segTemplate *mpd.SegmentTemplate, ext *segmentTemplateExt, startNumber int, periodDuration time.Duration, log *slog.Logger) int {
+	if ext != nil && ext.EndNumber != nil {
+		n := int(*ext.EndNumber) - startNumber + 1
+		if n < 0 {
+			return 0
+		}
+		return n
+	}
+
+	duration := int64PtrToI(segTemplate.Duration)
+	if duration <= 0 {
+		log.Warn("SegmentTemplate without duration or SegmentTimeline, can't figure out the number of segments")
+		return 0
+	}
+	if periodDuration <= 0 {
+		log.Warn("unknown period duration, can't figure out the number of segments")
+		return 0
+	}
+	timescale := 1
+	if segTemplate.Timescale != nil && *segTemplate.Timescale > 0 {
+		timescale = int64PtrToI(segTemplate.Timescale)
 	}
 
-	return
+	// ceil(periodDuration / segmentDuration), the last segment can be shorter
+	// (the epsilon protects exact multiples against float rounding)
+	segDuration := float64(duration) / float64(timescale)
+	return int(math.Ceil(periodDuration.Seconds()/segDuration - 1e-9))
 }
 
 // always returns a copy
@@ -170,9 +339,7 @@ func absBaseURL(manifestBaseURL *url.URL, elBaseURLs []string) *url.URL {
 	elBaseURL := elBaseURLs[0]
 	u, err := url.Parse(elBaseURL)
 	if err != nil {
-		if Debug {
-			fmt.Printf("failed to parse the base url %s - %s\n", elBaseURL, err)
-		}
+		packageLogger().Debug("failed to parse the base url", "url", elBaseURL, "err", err)
 		return manifestBaseURL
 	}
 	if u.IsAbs() {
@@ -200,32 +367,39 @@ func extractContentType(contentType, mimeType *string) string {
 	return UnknownString
 }
 
-func downloadFile(url string, path string) (*os.File, error) {
-	return downloadFileWithClient(http.DefaultClient, url, path)
-}
-
 // downloadFile downloads a file from a given url and saves it to a given path
 // it returns the file and an error if something goes wrong
 // It's the caller's responsibility to close the file.
-func downloadFileWithClient(client *http.Client, url string, path string) (*os.File, error) {
+func downloadFileWithClient(ctx context.Context, client *http.Client, url string, path string) (*os.File, error) {
+	return downloadFileRangeWithClient(ctx, client, url, "", path)
+}
+
+// downloadFileRangeWithClient downloads the passed byte range ("first-last")
+// of a file, the entire file is downloaded if the range is empty.
+func downloadFileRangeWithClient(ctx context.Context, client *http.Client, url string, byteRange string, path string) (*os.File, error) {
+	return downloadFileRequest(ctx, client, url, byteRange, nil, path, nil)
+}
+
+// downloadFileRequest downloads a byte range of a file, sending the extra
+// headers if any. The payload is validated if a check is passed.
+func downloadFileRequest(ctx context.Context, client *http.Client, url string, byteRange string, header http.Header, path string, check *payloadCheck) (*os.File, error) {
 	if client == nil {
 		client = http.DefaultClient
 	}
 
-	// check if there is a valid file at `path`
-	if fileExists(path) {
-		if Debug {
-			fmt.Println("-> File already exists at", path)
-		}
-		return os.Open(path)
-	}
-
 	// build the request with the proper headers
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
+	req = withConfiguredHeaders(req)
 	// req.Header.Add("Accept", "application/dash+xml,video/vnd.mpeg.dash.mpd")
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if byteRange != "" {
+		req.Header.Set("Range", "bytes="+byteRange)
+	}
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -234,26 +408,114 @@ func downloadFileWithClient(client *http.Client, url string, path string) (*os.F
 	defer resp.Body.Close()
 
 	// Check server response
-	if resp.StatusCode != http.StatusOK {
-		err := fmt.Errorf("bad status: %s", resp.Status)
-		return nil, err
+	if resp.StatusCode != http.StatusOK && !(byteRange != "" && resp.StatusCode == http.StatusPartialContent) {
+		return nil, newHTTPStatusError(resp)
+	}
+	// the server ignored the range request, we can't use the entire file
+	if byteRange != "" && resp.StatusCode == http.StatusOK {
+		return nil, fmt.Errorf("byte range %s requested - %w", byteRange, errRangeIgnored)
 	}
 
-	// Create the file
-	out, err := os.Create(path)
+	// the body is written to a .part file renamed once complete so an
+	// interrupted download is never mistaken for a complete file
+	partPath := path + partSuffix
+	out, err := os.Create(partPath)
 	if err != nil {
 		return nil, err
 	}
 
 	// Write the body to file
-	_, err = io.Copy(out, resp.Body)
+	n, err := io.Copy(out, resp.Body)
+	if err == nil && resp.ContentLength >= 0 && n != resp.ContentLength {
+		err = fmt.Errorf("received %d bytes out of %d - %w", n, resp.ContentLength, errIncompleteBody)
+	}
+	if err == nil && check != nil {
+		head := make([]byte, 512)
+		headSize, _ := out.ReadAt(head, 0)
+		err = check.validate(resp.Header.Get("Content-Type"), head[:headSize], n)
+	}
+	// without Content-Length, a truncated mp4 segment ends in the middle of
+	// a box
+	if err == nil && check != nil && check.container == containerMP4 {
+		if boxErr := validateMP4Boxes(partPath); boxErr != nil {
+			err = fmt.Errorf("%w - %v", errIncompleteBody, boxErr)
+		}
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(partPath, path)
+	}
 	if err != nil {
-		out.Close()
-		os.Remove(path)
+		os.Remove(partPath)
 		return nil, err
 	}
 
-	return out, nil
+	return os.Open(path)
+}
+
+// partSuffix is added to the files being downloaded.
+const partSuffix = ".part"
+
+// errIncompleteBody is returned when the connection is closed before the
+// announced Content-Length is received.
+var errIncompleteBody = errors.New("incomplete response body")
+
+// fetchRange downloads a byte range of a file of the stream (manifest,
+// index) in memory, the entire file is downloaded if the range is empty.
+func fetchRange(ctx context.Context, client *http.Client, url string, byteRange string) ([]byte, error) {
+	return fetch(ctx, client, url, byteRange, nil, true)
+}
+
+// fetchRemote downloads a resource referenced by the manifest from a third
+// party (xlink), the configured headers aren't sent.
+func fetchRemote(ctx context.Context, client *http.Client, url string) ([]byte, error) {
+	return fetch(ctx, client, url, "", nil, false)
+}
+
+// fetch downloads a byte range of a file in memory sending the extra headers
+// if any, and the configured headers if configuredHeaders is set.
+func fetch(ctx context.Context, client *http.Client, url string, byteRange string, header http.Header, configuredHeaders bool) ([]byte, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if configuredHeaders {
+		req = withConfiguredHeaders(req)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	expectedStatus := http.StatusOK
+	if byteRange != "" {
+		req.Header.Set("Range", "bytes="+byteRange)
+		expectedStatus = http.StatusPartialContent
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != expectedStatus {
+		return nil, newHTTPStatusError(resp)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// segmentFilename returns a filename usable on disk for the passed segment url.
+func segmentFilename(segURL string) string {
+	u, err := url.Parse(segURL)
+	if err != nil || u.Path == "" {
+		return filenameCleaner.Replace(filepath.Base(segURL))
+	}
+	return filenameCleaner.Replace(path.Base(u.Path))
 }
 
 func repCodecs(r *mpd.Representation) string {
@@ -268,6 +530,23 @@ func repCodecs(r *mpd.Representation) string {
 	return codecs
 }
 
+// isMP4Text reports if the text representation is packaged in mp4 (wvtt,
+// stpp) as opposed to a sidecar text file.
+func isMP4Text(r *mpd.Representation) bool {
+	if r == nil {
+		return false
+	}
+	codec := repCodecs(r)
+	if strings.Contains(codec, "wvtt") || strings.Contains(codec, "stpp") {
+		return true
+	}
+	mimeType := strPtrtoS(r.MimeType)
+	if mimeType == UnknownString && r.AdaptationSet != nil {
+		mimeType = strPtrtoS(r.AdaptationSet.MimeType)
+	}
+	return strings.Contains(mimeType, "mp4")
+}
+
 func guessedExtension(r *mpd.Representation) string {
 	if r == nil {
 		return ""
@@ -345,6 +624,13 @@ func strPtrtoS(s *string) string {
 	return *s
 }
 
+func strPtrtoEmpty(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
 func intPtrToI(d *int) int {
 	if d == nil {
 		return 0
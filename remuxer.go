@@ -2,6 +2,7 @@ package mpdgrabber
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -13,6 +14,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/abema/go-mp4"
 	"github.com/mattetti/mpdgrabber/subs"
@@ -31,11 +33,16 @@ func FfmpegPath() (string, error) {
 }
 
 func Mux(outFilePath string, audioTracks, videoTracks, textTracks []*OutputTrack) error {
+	return MuxContext(context.Background(), outFilePath, audioTracks, videoTracks, textTracks)
+}
+
+// MuxContext is like Mux but ffmpeg is killed when ctx is done, the partial
+// output file is removed.
+func MuxContext(ctx context.Context, outFilePath string, audioTracks, videoTracks, textTracks []*OutputTrack) error {
+	log := loggerFrom(ctx)
 	ffmpegPath, err := FfmpegPath()
 	if err != nil {
-		Logger.Fatalf("ffmpeg wasn't found on your system, it is required to convert video files.\n" +
-			"Temp file(s) left on your hardrive\n")
-		os.Exit(1)
+		return ErrFFmpegNotFound
 	}
 
 	// -y overwrites without asking
@@ -66,26 +73,25 @@ func Mux(outFilePath string, audioTracks, videoTracks, textTracks []*OutputTrack
 			outfileNameNoExt := strings.TrimSuffix(outFilePath, filepath.Ext(outFilePath))
 
 			if filepath.Ext(track.AbsolutePath) == ".ttml" {
-				fmt.Println("TTML subtitles found, but they aren't supported by FFMpeg")
-				// convert the ttml to vtt
+				// ffmpeg doesn't support ttml, the subtitles are converted to vtt
 				vttPath := outfileNameNoExt + ".vtt"
 				doc, err := subs.OpenTtml(track.AbsolutePath)
 				if err != nil {
-					Logger.Printf("Error parsing %s as ttml: %v\n", track.AbsolutePath, err)
+					log.Error("failed to parse the ttml subtitles", "path", track.AbsolutePath, "err", err)
 					continue
 				}
 				if err = doc.SaveAsVTT(vttPath); err != nil {
-					Logger.Printf("Error converting %s from ttml to vtt: %v\n", track.AbsolutePath, err)
+					log.Error("failed to convert the ttml subtitles to vtt", "path", track.AbsolutePath, "err", err)
 					continue
 				}
-				fmt.Println("We converted them to VTT subs and left the .ttml file for you")
+				log.Info("ttml subtitles converted to vtt, the .ttml file is kept", "path", vttPath)
 				args = append(args, "-i", vttPath)
 				mapArgs = append(mapArgs, "-map", fmt.Sprintf("%d:s", trackNbr))
 				trackNbr++
 
 				ttmlFilePath := outfileNameNoExt + ".ttml"
 				if err = os.Rename(track.AbsolutePath, ttmlFilePath); err != nil {
-					Logger.Printf("Error renaming %s to %s: %v\n", track.AbsolutePath, ttmlFilePath, err)
+					log.Error("failed to rename the subtitles", "path", track.AbsolutePath, "to", ttmlFilePath, "err", err)
 				}
 
 				continue
@@ -94,7 +100,7 @@ func Mux(outFilePath string, audioTracks, videoTracks, textTracks []*OutputTrack
 			// provide a copy of the file even if it's embedded in the container
 			subFilePath := outfileNameNoExt + filepath.Ext(track.AbsolutePath)
 			if err = os.Rename(track.AbsolutePath, subFilePath); err != nil {
-				Logger.Printf("Error renaming %s to %s: %v\n", track.AbsolutePath, subFilePath, err)
+				log.Error("failed to rename the subtitles", "path", track.AbsolutePath, "to", subFilePath, "err", err)
 			}
 
 			args = append(args, "-i", subFilePath)
@@ -105,7 +111,7 @@ func Mux(outFilePath string, audioTracks, videoTracks, textTracks []*OutputTrack
 	}
 
 	if trackNbr == 0 {
-		return fmt.Errorf("No tracks found, nothing to mux")
+		return &MuxError{Path: outFilePath, Err: errors.New("no tracks found, nothing to mux")}
 	}
 
 	// map tags
@@ -119,49 +125,91 @@ func Mux(outFilePath string, audioTracks, videoTracks, textTracks []*OutputTrack
 	)
 
 	args = append(args, outFilePath)
-	cmd := exec.Command(ffmpegPath, args...)
+	cmd := exec.CommandContext(ctx, ffmpegPath, args...)
+	// the ffmpeg output is logged, not printed
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	log.Debug("running ffmpeg", "args", cmd.Args)
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			os.Remove(outFilePath)
+			return ctx.Err()
+		}
+		log.Error("ffmpeg failed", "args", cmd.Args, "output", output.String(), "err", err)
+		return &MuxError{Path: outFilePath, Args: cmd.Args, Output: output.String(), Err: err}
+	}
+	log.Debug("ffmpeg done", "output", output.String())
 
-	// Pipe out the cmd output in debug mode
-	if Debug {
-		stdout, err := cmd.StdoutPipe()
-		if err != nil {
-			return err
+	tracks := append(audioTracks, videoTracks...)
+	for _, aFile := range tracks {
+		if err := os.Remove(aFile.AbsolutePath); err != nil {
+			log.Warn("couldn't delete the temp file, please delete it manually", "path", aFile.AbsolutePath, "err", err)
 		}
-		stderr, err := cmd.StderrPipe()
-		if err != nil {
-			return err
+	}
+
+	return nil
+}
+
+// concatFile is a file joined by concatFiles, duration is the duration of
+// its media (0 if unknown).
+type concatFile struct {
+	path     string
+	duration time.Duration
+}
+
+// concatList returns the ffconcat script listing the files.
+func concatList(files []concatFile) string {
+	var list strings.Builder
+	list.WriteString("ffconcat version 1.0\n")
+	for _, file := range files {
+		fmt.Fprintf(&list, "file '%s'\n", strings.ReplaceAll(file.path, "'", `'\''`))
+		if file.duration > 0 {
+			fmt.Fprintf(&list, "duration %.6f\n", file.duration.Seconds())
 		}
-		go io.Copy(os.Stdout, stdout)
-		go io.Copy(os.Stderr, stderr)
 	}
+	return list.String()
+}
 
-	if err := cmd.Start(); err != nil {
-		return err
+// concatFiles joins the files into a matroska file using the ffmpeg concat
+// demuxer: the timestamps of each file are shifted so it starts where the
+// previous one ends.
+func concatFiles(ctx context.Context, files []concatFile, outPath string) error {
+	log := loggerFrom(ctx)
+	ffmpegPath, err := FfmpegPath()
+	if err != nil {
+		return ErrFFmpegNotFound
 	}
-	if err := cmd.Wait(); err != nil {
-		Logger.Printf("ffmpeg Error: %v\n", err)
-		Logger.Println("args", cmd.Args)
-		return err
+	listPath := outPath + ".ffconcat"
+	if err := os.WriteFile(listPath, []byte(concatList(files)), 0644); err != nil {
+		return fmt.Errorf("failed to write the concat list %s - %w", listPath, err)
 	}
-
-	state := cmd.ProcessState
-	if !state.Success() {
-		Logger.Println("Error: something went wrong when trying to use ffmpeg")
-	} else {
-		tracks := append(audioTracks, videoTracks...)
-		// tracks = append(tracks, textTracks...)
-		for _, aFile := range tracks {
-			err = os.Remove(aFile.AbsolutePath)
-			if err != nil {
-				Logger.Println("Couldn't delete temp file: " + aFile.AbsolutePath + "\n Please delete manually.\n")
-			}
+	defer os.Remove(listPath)
+
+	args := []string{"-y", "-f", "concat", "-safe", "0", "-i", listPath, "-map", "0", "-c", "copy", "-f", "matroska", outPath}
+	cmd := exec.CommandContext(ctx, ffmpegPath, args...)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	log.Debug("running ffmpeg", "args", cmd.Args)
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			os.Remove(outPath)
+			return ctx.Err()
 		}
+		log.Error("ffmpeg failed", "args", cmd.Args, "output", output.String(), "err", err)
+		return &MuxError{Path: outPath, Args: cmd.Args, Output: output.String(), Err: err}
 	}
-
-	return err
+	log.Debug("ffmpeg done", "output", output.String())
+	return nil
 }
 
-func reassembleFile(tempPath string, suffix string, outPath string, nbrSegments int, cType ContentType) error {
+// reassembleFile concatenates the downloaded segments into outPath.
+// When extractText is set, the segments are mp4 fragments carrying wvtt or
+// stpp samples and only the text is written out.
+func reassembleFile(ctx context.Context, tempPath string, suffix string, outPath string, nbrSegments int, extractText bool) error {
 	// look for all files in path that start by the baseFilename and suffix
 	// for each file, open it and write it to the output file
 	files, err := filepath.Glob(tempPath + suffix + "*")
@@ -169,8 +217,7 @@ func reassembleFile(tempPath string, suffix string, outPath string, nbrSegments
 		return fmt.Errorf("failed to list files in %s - %w", tempPath, err)
 	}
 	if len(files) != nbrSegments {
-		Logger.Printf("expected %d files, got %d\n", nbrSegments, len(files))
-		Logger.Fatal("not enough files")
+		return fmt.Errorf("expected %d segment files, got %d - %w", nbrSegments, len(files), ErrMissingSegments)
 	}
 
 	out, err := os.Create(outPath)
@@ -196,7 +243,11 @@ func reassembleFile(tempPath string, suffix string, outPath string, nbrSegments
 	var timescale uint32
 	var currentTime int
 
+	log := loggerFrom(ctx)
 	for _, fPath := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 
 		in, err := os.Open(fPath)
 		if err != nil {
@@ -208,15 +259,12 @@ func reassembleFile(tempPath string, suffix string, outPath string, nbrSegments
 
 		// dealing with text files differently
 		// we write the data to the file, removing the mp4 encapsulation
-		if cType == ContentTypeText {
-			if Debug {
-				fmt.Println("--", fPath)
-			}
+		if extractText {
+			log.Debug("extracting the text of the segment", "path", fPath)
 			var baseTime int
 			var defaultSampleDuration uint32
 			var trun *mp4.Trun
 
-			// fmt.Println(fPath)
 			_, err = mp4.ReadBoxStructure(in, func(h *mp4.ReadHandle) (interface{}, error) {
 				switch h.Path[0] {
 				case mp4.BoxTypeMoov():
@@ -251,9 +299,7 @@ func reassembleFile(tempPath string, suffix string, outPath string, nbrSegments
 						language = string(mdhd.Language[:])
 					}
 
-					if Debug {
-						fmt.Println(">> Track", trackID, "language:", language, "timescale", timescale)
-					}
+					log.Debug("text track", "track_id", trackID, "lang", language, "timescale", timescale)
 
 					stsds, err := mp4.ExtractBoxWithPayload(in, &h.BoxInfo, mp4.BoxPath{
 						mp4.BoxTypeTrak(),
@@ -263,11 +309,9 @@ func reassembleFile(tempPath string, suffix string, outPath string, nbrSegments
 						mp4.BoxTypeStsd(),
 					})
 					if err != nil {
-						fmt.Println(err)
 						return nil, err
 					}
 					if len(stsds) == 0 {
-						fmt.Println("no stsd box")
 						return nil, errors.New("stsd box not found")
 					}
 					wvtts, _ := mp4.ExtractBox(in, &stsds[0].Info, mp4.BoxPath{mp4.StrToBoxType("wvtt")})
@@ -320,6 +364,9 @@ func reassembleFile(tempPath string, suffix string, outPath string, nbrSegments
 
 					// WEbVTT mdat box
 					if sawVTT {
+						if trun == nil {
+							return nil, errors.New("mdat box without trun box")
+						}
 						currentTime = baseTime
 
 						var sampleIDX int
@@ -331,9 +378,7 @@ func reassembleFile(tempPath string, suffix string, outPath string, nbrSegments
 							// That's what the presentation Sample Size represents
 							duration := presentation.SampleDuration
 							if duration == 0 {
-								if Debug {
-									fmt.Println("0 duration, backup:", defaultSampleDuration)
-								}
+								log.Debug("sample without duration, using the default one", "duration", defaultSampleDuration)
 								duration = defaultSampleDuration
 							}
 
@@ -356,8 +401,7 @@ func reassembleFile(tempPath string, suffix string, outPath string, nbrSegments
 								err := binary.Read(in, binary.BigEndian, &payloadSize)
 								_, err = in.Read(payloadType)
 								if err != nil {
-									fmt.Printf("[%d of %d| sample:%d] failed to read box size/type %v - sampleSize: %d, totalSize: %d\n", sampleIDX, len(trun.Entries), n, err, sampleSize, totalSize)
-									return nil, err
+									return nil, fmt.Errorf("failed to read the box size/type of sample %d/%d (size: %d, read: %d) - %w", sampleIDX, len(trun.Entries), sampleSize, totalSize, err)
 								}
 
 								sampleIDX++
@@ -371,25 +415,23 @@ func reassembleFile(tempPath string, suffix string, outPath string, nbrSegments
 									payload := make([]byte, int(payloadSize)-boxHeaderSize)
 									err := binary.Read(in, binary.BigEndian, &payload)
 									if err != nil {
-										fmt.Println("failed to read payload", err)
+										log.Warn("failed to read the vttc payload", "path", fPath, "err", err)
 										break
 									}
 									cue, err := subs.ParseVTTCPayload(payload, cueStart, cueEnd)
-									if Debug {
+									if debugEnabled(log) {
 										truncatedCue := cue
 										if len(cue) > 50 {
 											truncatedCue = truncatedCue[:45]
 										}
-										fmt.Printf("[%d of %d] sample: %d, %s\n", sampleIDX, len(trun.Entries), n, truncatedCue)
+										log.Debug("vtt cue", "sample", sampleIDX, "samples", len(trun.Entries), "cue", n, "text", truncatedCue)
 									}
 									if cue != "" {
 										trackCues = append(trackCues, cue)
 									}
 								} else {
 									// VTTE (empty cue)
-									if Debug {
-										fmt.Printf("[%d of %d] sample: %d, %s box, %s => %s\n", sampleIDX, len(trun.Entries), n, string(payloadType), subs.WebvttTimeString(cueStart), subs.WebvttTimeString(cueEnd))
-									}
+									log.Debug("empty vtt cue", "sample", sampleIDX, "samples", len(trun.Entries), "cue", n, "box", string(payloadType), "start", subs.WebvttTimeString(cueStart), "end", subs.WebvttTimeString(cueEnd))
 									// skip the rest of the box
 									in.Seek(int64(payloadSize)-int64(boxHeaderSize), io.SeekCurrent)
 								}
@@ -400,18 +442,16 @@ func reassembleFile(tempPath string, suffix string, outPath string, nbrSegments
 					// TTML
 					if sawSTTP {
 						payload := make([]byte, int(h.BoxInfo.Size)-int(h.BoxInfo.HeaderSize))
-						if Debug {
-							fmt.Println("TTML payload size:", len(payload))
-						}
+						log.Debug("ttml payload", "size", len(payload))
 						err := binary.Read(in, binary.BigEndian, &payload)
 						if err != nil {
-							fmt.Println("failed to read payload", err)
+							log.Warn("failed to read the ttml payload", "path", fPath, "err", err)
 							break
 						}
 						if ttmlDoc == nil {
 							ttmlDoc, err = subs.NewTtml(payload)
 							if err != nil {
-								Logger.Println("something wrong happened when parsing the ttml data", err)
+								log.Warn("failed to parse the ttml data", "path", fPath, "err", err)
 							}
 						} else {
 							ttmlDoc.MergeFromData(payload)
@@ -421,7 +461,9 @@ func reassembleFile(tempPath string, suffix string, outPath string, nbrSegments
 				}
 				return nil, nil
 			})
-
+			if err != nil {
+				return fmt.Errorf("failed to extract the text of %s into %s - %w", fPath, outPath, err)
+			}
 		} else {
 			// copy the file to the output file as is
 			_, err = io.Copy(out, in)
@@ -430,11 +472,9 @@ func reassembleFile(tempPath string, suffix string, outPath string, nbrSegments
 			}
 		}
 
+		// the segments stay in the workspace until the job is muxed, an
+		// interrupted job doesn't download them again
 		in.Close()
-		err = os.Remove(fPath)
-		if err != nil {
-			return fmt.Errorf("failed to remove %s - %w", fPath, err)
-		}
 	}
 
 	if sawVTT {
@@ -0,0 +1,37 @@
+package mpdgrabber
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReassembleFileCorruptTextSegment(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		segment string
+	}{
+		// the moov box announces a child box larger than itself
+		{"corrupt moov", "\x00\x00\x00\x10moov\x00\x00\x10\x00trak"},
+		{"corrupt moof", "\x00\x00\x00\x10moof\x00\x00\x00\x20traf"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := filepath.Join(dir, "text"+string(rune('a'+i)))
+			if err := os.WriteFile(base+"_seg_1", []byte(tt.segment), 0644); err != nil {
+				t.Fatal(err)
+			}
+			outPath := base + ".vtt"
+			err := reassembleFile(context.Background(), base, "_seg_", outPath, 1, true)
+			if err == nil {
+				t.Fatal("the corrupt segment wasn't reported")
+			}
+			if !strings.Contains(err.Error(), outPath) {
+				t.Errorf("the error doesn't mention the track %s: %v", outPath, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package mpdgrabber
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxRetryAfter caps the delay requested by a server through Retry-After.
+const maxRetryAfter = 5 * time.Minute
+
+// defaultInitialBackoff is used when RetryOptions.InitialBackoff isn't set.
+const defaultInitialBackoff = 500 * time.Millisecond
+
+// RetryOptions configures how failed segment downloads are retried.
+type RetryOptions struct {
+	// MaxRetries is the number of retries after the first attempt
+	MaxRetries int
+	// InitialBackoff is the delay before the first retry (500ms if 0), it
+	// doubles after each retry up to MaxBackoff (no limit if 0). A random
+	// jitter is applied to the delays.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// DefaultRetryOptions is used by the jobs without retry options.
+var DefaultRetryOptions = RetryOptions{
+	MaxRetries:     4,
+	InitialBackoff: defaultInitialBackoff,
+	MaxBackoff:     30 * time.Second,
+}
+
+// backoff returns the delay before the passed retry (1 for the first one),
+// between half and all of the exponential delay.
+func (o *RetryOptions) backoff(retry int) time.Duration {
+	delay := o.InitialBackoff
+	if delay <= 0 {
+		delay = defaultInitialBackoff
+	}
+	for i := 1; i < retry && delay < math.MaxInt64/2; i++ {
+		if o.MaxBackoff > 0 && delay >= o.MaxBackoff {
+			break
+		}
+		delay *= 2
+	}
+	if o.MaxBackoff > 0 && delay > o.MaxBackoff {
+		delay = o.MaxBackoff
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+// retryDelay returns the delay before retrying after err, the delay
+// requested by the server (Retry-After on 429 and 503) takes precedence.
+func (o *RetryOptions) retryDelay(retry int, err error) time.Duration {
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) && statusErr.RetryAfter > 0 {
+		if statusErr.RetryAfter > maxRetryAfter {
+			return maxRetryAfter
+		}
+		return statusErr.RetryAfter
+	}
+	return o.backoff(retry)
+}
+
+// httpStatusError is returned when the server doesn't respond with the
+// expected status.
+type httpStatusError struct {
+	StatusCode int
+	Status     string
+	// RetryAfter is the delay requested by the server on 429 and 503
+	RetryAfter time.Duration
+}
+
+func newHTTPStatusError(resp *http.Response) *httpStatusError {
+	err := &httpStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		err.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+	}
+	return err
+}
+
+func (e *httpStatusError) Error() string {
+	return "bad status: " + e.Status
+}
+
+// errRangeIgnored is returned when the server returns the entire file
+// instead of the requested byte range.
+var errRangeIgnored = errors.New("the server returned the entire file instead of the requested byte range")
+
+// isRetryable reports if a failed request might succeed if tried again.
+// Network errors and 408, 429 and 5xx statuses are retryable, the other
+// statuses (404...) aren't.
+func isRetryable(err error) bool {
+	if errors.Is(err, errRangeIgnored) {
+		return false
+	}
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		code := statusErr.StatusCode
+		return code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= 500
+	}
+	return true
+}
+
+// isHostFailure returns true if the error means the host is failing (network
+// errors, overloaded or failing server) and not that the resource is missing
+// or invalid on that host.
+func isHostFailure(err error) bool {
+	if errors.Is(err, ErrInvalidPayload) {
+		return false
+	}
+	return isRetryable(err)
+}
+
+// parseRetryAfter parses a Retry-After header, in seconds or as a http date.
+func parseRetryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
+
+// SegmentError is returned when a segment couldn't be downloaded, once the
+// retries are exhausted, errors.Is matches ErrSegmentDownload.
+type SegmentError struct {
+	ContentType      ContentType
+	RepresentationID string
+	// Index is the position of the segment in the track
+	Index    int
+	URL      string
+	Attempts int
+	Err      error
+}
+
+func (e *SegmentError) Error() string {
+	return fmt.Sprintf("failed to download %s segment %d of representation %s (%s) after %d attempts - %v",
+		e.ContentType, e.Index, e.RepresentationID, e.URL, e.Attempts, e.Err)
+}
+
+func (e *SegmentError) Unwrap() error {
+	return e.Err
+}
+
+func (e *SegmentError) Is(target error) bool {
+	return target == ErrSegmentDownload
+}
@@ -0,0 +1,66 @@
+package mpdgrabber
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  RetryOptions
+		retry int
+		// the delay is between half and all of the exponential delay
+		want time.Duration
+	}{
+		{"first retry", RetryOptions{InitialBackoff: time.Second, MaxBackoff: time.Minute}, 1, time.Second},
+		{"doubles after each retry", RetryOptions{InitialBackoff: time.Second, MaxBackoff: time.Minute}, 4, 8 * time.Second},
+		{"capped", RetryOptions{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}, 4, 5 * time.Second},
+		{"no cap without MaxBackoff", RetryOptions{InitialBackoff: time.Second}, 6, 32 * time.Second},
+		{"default InitialBackoff", RetryOptions{}, 1, defaultInitialBackoff},
+		{"default InitialBackoff doubles", RetryOptions{}, 3, 4 * defaultInitialBackoff},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 20; i++ {
+				got := tt.opts.backoff(tt.retry)
+				if got < tt.want/2 || got > tt.want {
+					t.Fatalf("backoff(%d) = %v, want between %v and %v", tt.retry, got, tt.want/2, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryBackoffDoesntOverflow(t *testing.T) {
+	opts := RetryOptions{InitialBackoff: time.Second}
+	if got := opts.backoff(200); got <= 0 {
+		t.Errorf("backoff(200) = %v, want a positive delay", got)
+	}
+}
+
+func TestJobRetryOptionsAreCopied(t *testing.T) {
+	g, err := NewGrabber(Options{Logger: discardLogger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	opts := &RetryOptions{MaxRetries: 2}
+	tests := []struct {
+		name   string
+		job    *WJob
+		source *RetryOptions
+	}{
+		{"default", &WJob{}, &DefaultRetryOptions},
+		{"job options", &WJob{Retry: opts}, opts},
+	}
+	for _, tt := range tests {
+		g.setup(tt.job)
+		if tt.job.retry == tt.source {
+			t.Errorf("%s: the job points to the retry options instead of a copy", tt.name)
+		}
+		if *tt.job.retry != *tt.source {
+			t.Errorf("%s: job retry = %+v, want %+v", tt.name, *tt.job.retry, *tt.source)
+		}
+	}
+}
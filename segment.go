@@ -0,0 +1,116 @@
+package mpdgrabber
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/mattetti/go-dash/mpd"
+)
+
+// Segment is a single media (or initialization) segment of a representation.
+type Segment struct {
+	URL string
+	// Mirrors are the urls of the segment on the alternative BaseURLs, in
+	// order of preference.
+	Mirrors []string
+	// ByteRange is the optional "first-last" byte range of the segment in the
+	// resource pointed by URL (SegmentList@mediaRange, Initialization@range)
+	ByteRange string
+	// Init is true for the initialization segment, it doesn't have a number
+	// nor timing information.
+	Init bool
+	// Number is the segment number as substituted for $Number$
+	Number int64
+	// Time is the start of the segment in timescale units as substituted for
+	// $Time$ (presentationTimeOffset not applied)
+	Time      uint64
+	Timescale uint64
+	// Start is the start of the segment relative to the start of the period
+	// (presentationTimeOffset applied) and Duration its duration.
+	Start    time.Duration
+	Duration time.Duration
+}
+
+// End returns the end of the segment relative to the start of the period.
+func (s *Segment) End() time.Duration {
+	return s.Start + s.Duration
+}
+
+// timelineEntry is an expanded SegmentTimeline S element.
+type timelineEntry struct {
+	time     uint64
+	duration uint64
+}
+
+// expandTimeline expands the S elements of a SegmentTimeline into individual
+// entries following ISO/IEC 23009-1 §5.3.9.6:
+//   - a missing @t on the first S element means 0, on other elements it
+//     means the end of the previous segment.
+//   - a negative @r repeats the segment until the next S@t or, for the last
+//     element, until the end of the period.
+//
+// periodEnd is expressed in timescale units (presentationTimeOffset
+// included), 0 means unknown.
+func expandTimeline(timeline *mpd.SegmentTimeline, periodEnd uint64, log *slog.Logger) []timelineEntry {
+	if timeline == nil {
+		return nil
+	}
+	var entries []timelineEntry
+	var t uint64
+	for i, s := range timeline.Segments {
+		if s.StartTime != nil {
+			t = *s.StartTime
+		}
+		if s.Duration == 0 {
+			log.Warn("SegmentTimeline S element without duration, skipping it", "index", i)
+			continue
+		}
+
+		repeat := intPtrToI(s.RepeatCount)
+		if repeat < 0 {
+			// repeat until the next explicit start time or the end of the period
+			var end uint64
+			if i+1 < len(timeline.Segments) && timeline.Segments[i+1].StartTime != nil {
+				end = *timeline.Segments[i+1].StartTime
+			} else {
+				end = periodEnd
+			}
+			if end <= t {
+				log.Warn("SegmentTimeline S element with r=-1 but the end of the repetition is unknown", "index", i)
+				repeat = 0
+			} else {
+				// ceil((end - t) / d) segments, the first one isn't a repeat
+				repeat = int((end-t+s.Duration-1)/s.Duration) - 1
+			}
+		}
+
+		for j := 0; j <= repeat; j++ {
+			entries = append(entries, timelineEntry{time: t, duration: s.Duration})
+			t += s.Duration
+		}
+	}
+	return entries
+}
+
+// timescaleDuration converts a value in timescale units into a duration
+// without overflowing for large values.
+func timescaleDuration(value int64, timescale uint64) time.Duration {
+	if timescale == 0 {
+		timescale = 1
+	}
+	ts := int64(timescale)
+	return time.Duration(value/ts)*time.Second + time.Duration(value%ts)*time.Second/time.Duration(ts)
+}
+
+// durationToTimescale converts a duration into timescale units.
+func durationToTimescale(d time.Duration, timescale uint64) uint64 {
+	if d <= 0 {
+		return 0
+	}
+	if timescale == 0 {
+		timescale = 1
+	}
+	secs := uint64(d / time.Second)
+	frac := uint64(d % time.Second)
+	return secs*timescale + frac*timescale/uint64(time.Second)
+}
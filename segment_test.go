@@ -0,0 +1,180 @@
+package mpdgrabber
+
+import (
+	"encoding/xml"
+	"io"
+	"log/slog"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mattetti/go-dash/mpd"
+)
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func readTimeline(t *testing.T, s string) *mpd.SegmentTimeline {
+	t.Helper()
+	timeline := &mpd.SegmentTimeline{}
+	if err := xml.Unmarshal([]byte(s), timeline); err != nil {
+		t.Fatalf("invalid SegmentTimeline %s - %v", s, err)
+	}
+	return timeline
+}
+
+func TestExpandTimeline(t *testing.T) {
+	tests := []struct {
+		name      string
+		timeline  string
+		periodEnd uint64
+		want      []timelineEntry
+	}{
+		{
+			name:     "missing first t starts at 0",
+			timeline: `<SegmentTimeline><S d="10" r="1"/></SegmentTimeline>`,
+			want:     []timelineEntry{{0, 10}, {10, 10}},
+		},
+		{
+			name:     "missing t continues from the previous segment",
+			timeline: `<SegmentTimeline><S t="100" d="10" r="1"/><S d="5"/></SegmentTimeline>`,
+			want:     []timelineEntry{{100, 10}, {110, 10}, {120, 5}},
+		},
+		{
+			name:     "explicit t leaves a gap",
+			timeline: `<SegmentTimeline><S t="0" d="10"/><S t="15" d="10"/></SegmentTimeline>`,
+			want:     []timelineEntry{{0, 10}, {15, 10}},
+		},
+		{
+			name:     "r=-1 bounded by the next S@t",
+			timeline: `<SegmentTimeline><S t="0" d="10" r="-1"/><S t="40" d="5"/></SegmentTimeline>`,
+			want:     []timelineEntry{{0, 10}, {10, 10}, {20, 10}, {30, 10}, {40, 5}},
+		},
+		{
+			name:     "r=-1 with the next S@t in the middle of a segment",
+			timeline: `<SegmentTimeline><S t="0" d="10" r="-1"/><S t="25" d="5"/></SegmentTimeline>`,
+			want:     []timelineEntry{{0, 10}, {10, 10}, {20, 10}, {25, 5}},
+		},
+		{
+			name:      "r=-1 bounded by the period end",
+			timeline:  `<SegmentTimeline><S t="0" d="10" r="1"/><S d="20" r="-1"/></SegmentTimeline>`,
+			periodEnd: 80,
+			want:      []timelineEntry{{0, 10}, {10, 10}, {20, 20}, {40, 20}, {60, 20}},
+		},
+		{
+			name:      "r=-1 with the period end in the middle of a segment",
+			timeline:  `<SegmentTimeline><S t="0" d="10" r="-1"/></SegmentTimeline>`,
+			periodEnd: 25,
+			want:      []timelineEntry{{0, 10}, {10, 10}, {20, 10}},
+		},
+		{
+			name:      "r=-1 bounded by the period end with a presentationTimeOffset",
+			timeline:  `<SegmentTimeline><S t="1000" d="10" r="-1"/></SegmentTimeline>`,
+			periodEnd: 1030,
+			want:      []timelineEntry{{1000, 10}, {1010, 10}, {1020, 10}},
+		},
+		{
+			name:     "r=-1 without a known end",
+			timeline: `<SegmentTimeline><S t="0" d="10" r="-1"/></SegmentTimeline>`,
+			want:     []timelineEntry{{0, 10}},
+		},
+		{
+			name:      "r=-1 with the period end before the segment",
+			timeline:  `<SegmentTimeline><S t="100" d="10" r="-1"/></SegmentTimeline>`,
+			periodEnd: 50,
+			want:      []timelineEntry{{100, 10}},
+		},
+		{
+			name:     "S without duration is skipped",
+			timeline: `<SegmentTimeline><S t="0" d="10"/><S d="0" r="3"/><S d="10"/></SegmentTimeline>`,
+			want:     []timelineEntry{{0, 10}, {10, 10}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := expandTimeline(readTimeline(t, tt.timeline), tt.periodEnd, discardLogger)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expandTimeline() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTemplateSubstitutionPresentationTimeOffset(t *testing.T) {
+	media := "$RepresentationID$/$Time$.m4s"
+	timescale := int64(1000)
+	pto := uint64(50000)
+	segTemplate := &mpd.SegmentTemplate{
+		Media:                  &media,
+		Timescale:              &timescale,
+		PresentationTimeOffset: &pto,
+		SegmentTimeline:        readTimeline(t, `<SegmentTimeline><S t="50000" d="2000" r="-1"/></SegmentTimeline>`),
+	}
+	id := "audio"
+	r := &mpd.Representation{ID: &id}
+
+	segments, err := templateSubstitution(&media, segTemplate, nil, r, 5*time.Second, discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		url      string
+		time     uint64
+		start    time.Duration
+		duration time.Duration
+	}{
+		{"audio/50000.m4s", 50000, 0, 2 * time.Second},
+		{"audio/52000.m4s", 52000, 2 * time.Second, 2 * time.Second},
+		{"audio/54000.m4s", 54000, 4 * time.Second, 2 * time.Second},
+	}
+	if len(segments) != len(want) {
+		t.Fatalf("got %d segments, want %d", len(segments), len(want))
+	}
+	for i, w := range want {
+		s := segments[i]
+		if s.URL != w.url || s.Time != w.time || s.Start != w.start || s.Duration != w.duration {
+			t.Errorf("segment %d = {%s %d %v %v}, want {%s %d %v %v}", i, s.URL, s.Time, s.Start, s.Duration, w.url, w.time, w.start, w.duration)
+		}
+		if s.Number != int64(i+1) {
+			t.Errorf("segment %d number = %d, want %d", i, s.Number, i+1)
+		}
+	}
+}
+
+func TestTemplateSubstitutionNumberedPresentationTimeOffset(t *testing.T) {
+	media := "seg_$Number%03d$.m4s"
+	timescale := int64(90000)
+	duration := int64(180000)
+	startNumber := int64(10)
+	pto := uint64(900000)
+	segTemplate := &mpd.SegmentTemplate{
+		Media:                  &media,
+		Timescale:              &timescale,
+		Duration:               &duration,
+		StartNumber:            &startNumber,
+		PresentationTimeOffset: &pto,
+	}
+	r := &mpd.Representation{}
+
+	segments, err := templateSubstitution(&media, segTemplate, nil, r, 5*time.Second, discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 3 {
+		t.Fatalf("got %d segments, want 3", len(segments))
+	}
+	last := segments[2]
+	if last.URL != "seg_012.m4s" {
+		t.Errorf("last segment url = %s, want seg_012.m4s", last.URL)
+	}
+	// $Time$ includes the presentationTimeOffset, Start doesn't
+	if last.Time != pto+2*uint64(duration) {
+		t.Errorf("last segment time = %d, want %d", last.Time, pto+2*uint64(duration))
+	}
+	if last.Start != 4*time.Second {
+		t.Errorf("last segment start = %v, want 4s", last.Start)
+	}
+	// the last segment stops at the end of the period
+	if last.Duration != time.Second {
+		t.Errorf("last segment duration = %v, want 1s", last.Duration)
+	}
+}
@@ -0,0 +1,240 @@
+package mpdgrabber
+
+import (
+	"github.com/mattetti/go-dash/mpd"
+)
+
+// segmentAddressing is the way the segments of a representation are
+// described in the manifest.
+type segmentAddressing int
+
+const (
+	addressingUnknown segmentAddressing = iota
+	// SegmentBase or a plain BaseURL: one file for the whole representation
+	addressingBase
+	addressingList
+	addressingTemplate
+)
+
+func (a segmentAddressing) String() string {
+	switch a {
+	case addressingBase:
+		return "SegmentBase"
+	case addressingList:
+		return "SegmentList"
+	case addressingTemplate:
+		return "SegmentTemplate"
+	default:
+		return UnknownString
+	}
+}
+
+// segmentInfo is the effective segment information of a representation.
+// In DASH, SegmentBase, SegmentList and SegmentTemplate can be set on the
+// Period, the AdaptationSet and the Representation, the attributes set on a
+// lower level override the ones inherited from the upper levels.
+// For instance, the AdaptationSet can provide @media and @timescale while each
+// Representation provides its own SegmentTimeline.
+type segmentInfo struct {
+	Addressing segmentAddressing
+	// only one of those is set depending on the addressing, they are merged
+	// copies and can safely be modified.
+	Base        *mpd.SegmentBase
+	List        *mpd.SegmentList
+	Template    *mpd.SegmentTemplate
+	TemplateExt *segmentTemplateExt
+}
+
+// resolveSegmentInfo builds the effective segment information of a
+// representation from the 3 levels of the hierarchy.
+func resolveSegmentInfo(m *manifest, period *mpd.Period, as *mpd.AdaptationSet, r *mpd.Representation) *segmentInfo {
+	info := &segmentInfo{}
+	if r == nil {
+		return info
+	}
+	if as == nil {
+		as = r.AdaptationSet
+	}
+	if as == nil {
+		as = &mpd.AdaptationSet{}
+	}
+	if period == nil {
+		period = &mpd.Period{}
+	}
+
+	/*
+		  See https://bitmovin.com/dynamic-adaptive-streaming-http-mpeg-dash/#:~:text=4%3A%20Segment%20Referencing%20Schemes
+
+			A representation should only contain one of the following options:
+			* one or more SegmentList elements
+			* one SegmentTemplate
+			* one or more BaseURL elements, at most one SegmentBase element and no SegmentTemplate or SegmentList element.
+	*/
+
+	// the most specific level decides of the addressing scheme
+	info.Addressing = addressingOf(r.SegmentBase, r.SegmentList, r.SegmentTemplate)
+	if info.Addressing == addressingUnknown {
+		info.Addressing = addressingOf(as.SegmentBase, as.SegmentList, as.SegmentTemplate)
+	}
+	if info.Addressing == addressingUnknown {
+		info.Addressing = addressingOf(period.SegmentBase, period.SegmentList, period.SegmentTemplate)
+	}
+	// no segment information, the BaseURL points to the media file
+	if info.Addressing == addressingUnknown && (len(r.BaseURL) > 0 || len(as.BaseURL) > 0) {
+		info.Addressing = addressingBase
+	}
+
+	switch info.Addressing {
+	case addressingBase:
+		info.Base = mergeSegmentBases(period.SegmentBase, as.SegmentBase, r.SegmentBase)
+	case addressingList:
+		info.List = mergeSegmentLists(period.SegmentList, as.SegmentList, r.SegmentList)
+	case addressingTemplate:
+		info.Template = mergeSegmentTemplates(period.SegmentTemplate, as.SegmentTemplate, r.SegmentTemplate)
+		info.TemplateExt = mergeSegmentTemplateExts(
+			m.templateExt(period.SegmentTemplate),
+			m.templateExt(as.SegmentTemplate),
+			m.templateExt(r.SegmentTemplate),
+		)
+		// an inherited template without @media can't address anything,
+		// a BaseURL on the representation points to the media file instead.
+		if info.Template.Media == nil && len(r.BaseURL) > 0 {
+			info.Addressing = addressingBase
+			info.Base = mergeSegmentBases(period.SegmentBase, as.SegmentBase, r.SegmentBase)
+			info.Template, info.TemplateExt = nil, nil
+		}
+	}
+	return info
+}
+
+func addressingOf(base *mpd.SegmentBase, list *mpd.SegmentList, template *mpd.SegmentTemplate) segmentAddressing {
+	switch {
+	case template != nil:
+		return addressingTemplate
+	case list != nil:
+		return addressingList
+	case base != nil:
+		return addressingBase
+	}
+	return addressingUnknown
+}
+
+// mergeSegmentTemplates merges the templates from the highest to the lowest
+// level, nil templates are ignored.
+func mergeSegmentTemplates(levels ...*mpd.SegmentTemplate) *mpd.SegmentTemplate {
+	merged := &mpd.SegmentTemplate{}
+	for _, t := range levels {
+		if t == nil {
+			continue
+		}
+		if t.AdaptationSet != nil {
+			merged.AdaptationSet = t.AdaptationSet
+		}
+		if t.SegmentTimeline != nil {
+			merged.SegmentTimeline = t.SegmentTimeline
+		}
+		if t.PresentationTimeOffset != nil {
+			merged.PresentationTimeOffset = t.PresentationTimeOffset
+		}
+		if t.Duration != nil {
+			merged.Duration = t.Duration
+		}
+		if t.Initialization != nil {
+			merged.Initialization = t.Initialization
+		}
+		if t.Media != nil {
+			merged.Media = t.Media
+		}
+		if t.StartNumber != nil {
+			merged.StartNumber = t.StartNumber
+		}
+		if t.Timescale != nil {
+			merged.Timescale = t.Timescale
+		}
+	}
+	return merged
+}
+
+func mergeSegmentTemplateExts(levels ...*segmentTemplateExt) *segmentTemplateExt {
+	merged := &segmentTemplateExt{}
+	for _, ext := range levels {
+		if ext == nil {
+			continue
+		}
+		if ext.EndNumber != nil {
+			merged.EndNumber = ext.EndNumber
+		}
+		if ext.Index != nil {
+			merged.Index = ext.Index
+		}
+		if ext.BitstreamSwitching != nil {
+			merged.BitstreamSwitching = ext.BitstreamSwitching
+		}
+	}
+	return merged
+}
+
+func mergeSegmentLists(levels ...*mpd.SegmentList) *mpd.SegmentList {
+	merged := &mpd.SegmentList{}
+	for _, l := range levels {
+		if l == nil {
+			continue
+		}
+		mergeSegmentBaseInto(&merged.SegmentBase, &l.SegmentBase)
+		if l.SegmentTimeline != nil {
+			merged.SegmentTimeline = l.SegmentTimeline
+		}
+		if l.BitstreamSwitching != nil {
+			merged.BitstreamSwitching = l.BitstreamSwitching
+		}
+		if l.Duration != nil {
+			merged.Duration = l.Duration
+		}
+		if l.StartNumber != nil {
+			merged.StartNumber = l.StartNumber
+		}
+		// the segment urls aren't merged, the lowest level listing urls wins
+		if len(l.SegmentURLs) > 0 {
+			merged.SegmentURLs = l.SegmentURLs
+		}
+	}
+	return merged
+}
+
+func mergeSegmentBases(levels ...*mpd.SegmentBase) *mpd.SegmentBase {
+	merged := &mpd.SegmentBase{}
+	for _, b := range levels {
+		if b == nil {
+			continue
+		}
+		mergeSegmentBaseInto(merged, b)
+	}
+	return merged
+}
+
+func mergeSegmentBaseInto(dst, src *mpd.SegmentBase) {
+	if src.Initialization != nil {
+		dst.Initialization = src.Initialization
+	}
+	if src.RepresentationIndex != nil {
+		dst.RepresentationIndex = src.RepresentationIndex
+	}
+	if src.Timescale != nil {
+		dst.Timescale = src.Timescale
+	}
+	if src.PresentationTimeOffset != nil {
+		dst.PresentationTimeOffset = src.PresentationTimeOffset
+	}
+	if src.IndexRange != nil {
+		dst.IndexRange = src.IndexRange
+	}
+	if src.IndexRangeExact != nil {
+		dst.IndexRangeExact = src.IndexRangeExact
+	}
+	if src.AvailabilityTimeOffset != nil {
+		dst.AvailabilityTimeOffset = src.AvailabilityTimeOffset
+	}
+	if src.AvailabilityTimeComplete != nil {
+		dst.AvailabilityTimeComplete = src.AvailabilityTimeComplete
+	}
+}
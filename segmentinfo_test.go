@@ -0,0 +1,316 @@
+package mpdgrabber
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mattetti/go-dash/mpd"
+)
+
+// segmentInfoSummary flattens the resolved segment information to compare it
+// in table tests.
+type segmentInfoSummary struct {
+	Addressing     segmentAddressing
+	Media          string
+	Initialization string
+	Timescale      int
+	Duration       int
+	StartNumber    int
+	PTO            int
+	EndNumber      int
+	TimelineS      int
+	IndexRange     string
+	SegmentURLs    int
+}
+
+func summarizeSegmentInfo(info *segmentInfo) segmentInfoSummary {
+	s := segmentInfoSummary{Addressing: info.Addressing}
+	switch info.Addressing {
+	case addressingTemplate:
+		s.Media = strPtrtoS(info.Template.Media)
+		s.Initialization = strPtrtoS(info.Template.Initialization)
+		s.Timescale = int64PtrToI(info.Template.Timescale)
+		s.Duration = int64PtrToI(info.Template.Duration)
+		s.StartNumber = int64PtrToI(info.Template.StartNumber)
+		s.PTO = uint64PtrToI(info.Template.PresentationTimeOffset)
+		s.EndNumber = int64PtrToI(info.TemplateExt.EndNumber)
+		if info.Template.SegmentTimeline != nil {
+			s.TimelineS = len(info.Template.SegmentTimeline.Segments)
+		}
+	case addressingList:
+		if info.List.Initialization != nil {
+			s.Initialization = strPtrtoS(info.List.Initialization.SourceURL)
+		}
+		s.Timescale = uint32PtrToI(info.List.Timescale)
+		s.Duration = uint32PtrToI(info.List.Duration)
+		s.SegmentURLs = len(info.List.SegmentURLs)
+	case addressingBase:
+		if info.Base.Initialization != nil {
+			s.Initialization = strPtrtoS(info.Base.Initialization.Range)
+		}
+		s.Timescale = uint32PtrToI(info.Base.Timescale)
+		s.PTO = uint64PtrToI(info.Base.PresentationTimeOffset)
+		if info.Base.IndexRange != nil {
+			s.IndexRange = *info.Base.IndexRange
+		}
+	}
+	return s
+}
+
+const mpdHeader = `<?xml version="1.0" encoding="UTF-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static" mediaPresentationDuration="PT6S" minBufferTime="PT2S" profiles="urn:mpeg:dash:profile:isoff-live:2011">
+`
+
+func TestResolveSegmentInfo(t *testing.T) {
+	tests := []struct {
+		name string
+		// period is the content of the first Period, the tested
+		// representation is the last one of the last AdaptationSet.
+		period string
+		want   segmentInfoSummary
+		// urls are the expected media segment urls for templates
+		urls []string
+	}{
+		{
+			name: "Shaka Packager live profile, template on the representation",
+			period: `<AdaptationSet id="0" contentType="video" segmentAlignment="true">
+  <Representation id="0" bandwidth="1200000" codecs="avc1.64001f" mimeType="video/mp4" width="1280" height="720">
+    <SegmentTemplate timescale="90000" initialization="video_720p_init.mp4" media="video_720p_$Number$.m4s" startNumber="1">
+      <SegmentTimeline>
+        <S t="0" d="180000" r="1"/>
+        <S t="360000" d="180000"/>
+      </SegmentTimeline>
+    </SegmentTemplate>
+  </Representation>
+</AdaptationSet>`,
+			want: segmentInfoSummary{
+				Addressing:     addressingTemplate,
+				Media:          "video_720p_$Number$.m4s",
+				Initialization: "video_720p_init.mp4",
+				Timescale:      90000,
+				StartNumber:    1,
+				TimelineS:      2,
+			},
+			urls: []string{"video_720p_1.m4s", "video_720p_2.m4s", "video_720p_3.m4s"},
+		},
+		{
+			name: "Shaka Packager on-demand profile, SegmentBase with a BaseURL",
+			period: `<AdaptationSet id="0" contentType="audio" subsegmentAlignment="true">
+  <Representation id="1" bandwidth="128000" codecs="mp4a.40.2" mimeType="audio/mp4" audioSamplingRate="48000">
+    <BaseURL>audio.mp4</BaseURL>
+    <SegmentBase indexRange="763-850" timescale="48000">
+      <Initialization range="0-762"/>
+    </SegmentBase>
+  </Representation>
+</AdaptationSet>`,
+			want: segmentInfoSummary{
+				Addressing:     addressingBase,
+				Initialization: "0-762",
+				Timescale:      48000,
+				IndexRange:     "763-850",
+			},
+		},
+		{
+			name: "Bento4 mp4dash, numbered template on the adaptation set",
+			period: `<AdaptationSet mimeType="video/mp4" segmentAlignment="true" startWithSAP="1">
+  <SegmentTemplate timescale="1000" duration="2000" initialization="$RepresentationID$/init.mp4" media="$RepresentationID$/seg-$Number$.m4s" startNumber="1"/>
+  <Representation id="video/avc1" codecs="avc1.640028" width="1920" height="1080" bandwidth="4500000"/>
+</AdaptationSet>`,
+			want: segmentInfoSummary{
+				Addressing:     addressingTemplate,
+				Media:          "$RepresentationID$/seg-$Number$.m4s",
+				Initialization: "$RepresentationID$/init.mp4",
+				Timescale:      1000,
+				Duration:       2000,
+				StartNumber:    1,
+			},
+			urls: []string{"video/avc1/seg-1.m4s", "video/avc1/seg-2.m4s", "video/avc1/seg-3.m4s"},
+		},
+		{
+			name: "Unified Streaming, time based template and timeline on the adaptation set",
+			period: `<AdaptationSet id="1" group="1" contentType="audio" lang="en" segmentAlignment="true" audioSamplingRate="48000" mimeType="audio/mp4" codecs="mp4a.40.2">
+  <SegmentTemplate timescale="48000" initialization="tears-of-steel-$RepresentationID$.dash" media="tears-of-steel-$RepresentationID$-$Time$.dash">
+    <SegmentTimeline>
+      <S t="0" d="96256" r="1"/>
+      <S d="95232"/>
+    </SegmentTimeline>
+  </SegmentTemplate>
+  <Representation id="audio_eng=128002" bandwidth="128002"/>
+</AdaptationSet>`,
+			want: segmentInfoSummary{
+				Addressing:     addressingTemplate,
+				Media:          "tears-of-steel-$RepresentationID$-$Time$.dash",
+				Initialization: "tears-of-steel-$RepresentationID$.dash",
+				Timescale:      48000,
+				TimelineS:      2,
+			},
+			urls: []string{
+				"tears-of-steel-audio_eng=128002-0.dash",
+				"tears-of-steel-audio_eng=128002-96256.dash",
+				"tears-of-steel-audio_eng=128002-192512.dash",
+			},
+		},
+		{
+			name: "AWS MediaPackage, template on each representation with a presentationTimeOffset",
+			period: `<AdaptationSet mimeType="video/mp4" segmentAlignment="true" startWithSAP="1">
+  <Representation id="1" width="640" height="360" frameRate="30/1" bandwidth="730000" codecs="avc1.4D401E">
+    <SegmentTemplate timescale="30000" presentationTimeOffset="900000" media="index_video_1_0_$Number$.mp4?m=1566416213" initialization="index_video_1_0_init.mp4?m=1566416213" startNumber="15">
+      <SegmentTimeline>
+        <S t="900000" d="60000" r="2"/>
+      </SegmentTimeline>
+    </SegmentTemplate>
+  </Representation>
+</AdaptationSet>`,
+			want: segmentInfoSummary{
+				Addressing:     addressingTemplate,
+				Media:          "index_video_1_0_$Number$.mp4?m=1566416213",
+				Initialization: "index_video_1_0_init.mp4?m=1566416213",
+				Timescale:      30000,
+				StartNumber:    15,
+				PTO:            900000,
+				TimelineS:      1,
+			},
+			urls: []string{
+				"index_video_1_0_15.mp4?m=1566416213",
+				"index_video_1_0_16.mp4?m=1566416213",
+				"index_video_1_0_17.mp4?m=1566416213",
+			},
+		},
+		{
+			name: "media and timescale on the adaptation set, timeline on the representation",
+			period: `<AdaptationSet mimeType="audio/mp4" segmentAlignment="true">
+  <SegmentTemplate timescale="44100" media="audio_$RepresentationID$_$Time$.m4s" initialization="audio_$RepresentationID$_init.m4s"/>
+  <Representation id="96k" bandwidth="96000">
+    <SegmentTemplate>
+      <SegmentTimeline>
+        <S t="0" d="88200" r="2"/>
+      </SegmentTimeline>
+    </SegmentTemplate>
+  </Representation>
+</AdaptationSet>`,
+			want: segmentInfoSummary{
+				Addressing:     addressingTemplate,
+				Media:          "audio_$RepresentationID$_$Time$.m4s",
+				Initialization: "audio_$RepresentationID$_init.m4s",
+				Timescale:      44100,
+				TimelineS:      1,
+			},
+			urls: []string{"audio_96k_0.m4s", "audio_96k_88200.m4s", "audio_96k_176400.m4s"},
+		},
+		{
+			name: "period template overridden by the adaptation set and the representation",
+			period: `<SegmentTemplate timescale="1000" duration="2000" media="$RepresentationID$_$Number$.m4s" initialization="$RepresentationID$_init.m4s" startNumber="0"/>
+<AdaptationSet mimeType="video/mp4">
+  <SegmentTemplate duration="3000" endNumber="1"/>
+  <Representation id="v1" bandwidth="500000">
+    <SegmentTemplate startNumber="5"/>
+  </Representation>
+</AdaptationSet>`,
+			want: segmentInfoSummary{
+				Addressing:     addressingTemplate,
+				Media:          "$RepresentationID$_$Number$.m4s",
+				Initialization: "$RepresentationID$_init.m4s",
+				Timescale:      1000,
+				Duration:       3000,
+				StartNumber:    5,
+				// endNumber 1 is before startNumber 5
+				EndNumber: 1,
+			},
+		},
+		{
+			name: "segment list initialization inherited from the adaptation set",
+			period: `<AdaptationSet mimeType="video/mp4">
+  <SegmentList timescale="1000" duration="2000">
+    <Initialization sourceURL="init.mp4"/>
+  </SegmentList>
+  <Representation id="v1" bandwidth="500000">
+    <SegmentList>
+      <SegmentURL media="seg1.m4s"/>
+      <SegmentURL media="seg2.m4s"/>
+    </SegmentList>
+  </Representation>
+</AdaptationSet>`,
+			want: segmentInfoSummary{
+				Addressing:     addressingList,
+				Initialization: "init.mp4",
+				Timescale:      1000,
+				Duration:       2000,
+				SegmentURLs:    2,
+			},
+		},
+		{
+			name: "inherited template without media and a representation BaseURL",
+			period: `<AdaptationSet mimeType="audio/mp4">
+  <SegmentTemplate timescale="48000"/>
+  <Representation id="a1" bandwidth="128000">
+    <BaseURL>audio.mp4</BaseURL>
+  </Representation>
+</AdaptationSet>`,
+			want: segmentInfoSummary{Addressing: addressingBase},
+		},
+		{
+			name: "plain BaseURL on the representation",
+			period: `<AdaptationSet mimeType="text/vtt" lang="en">
+  <Representation id="sub_en" bandwidth="256">
+    <BaseURL>subs_en.vtt</BaseURL>
+  </Representation>
+</AdaptationSet>`,
+			want: segmentInfoSummary{Addressing: addressingBase},
+		},
+		{
+			name: "no segment information",
+			period: `<AdaptationSet mimeType="video/mp4">
+  <Representation id="v1" bandwidth="500000"/>
+</AdaptationSet>`,
+			want: segmentInfoSummary{Addressing: addressingUnknown},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := readManifest([]byte(mpdHeader + "<Period id=\"0\" start=\"PT0S\">\n" + tt.period + "\n</Period>\n</MPD>"))
+			if err != nil {
+				t.Fatalf("failed to read the manifest - %v", err)
+			}
+			period := m.Periods[0]
+			as := period.AdaptationSets[len(period.AdaptationSets)-1]
+			r := as.Representations[len(as.Representations)-1]
+
+			info := resolveSegmentInfo(m, period, as, r)
+			if got := summarizeSegmentInfo(info); got != tt.want {
+				t.Errorf("resolveSegmentInfo() =\n%+v\nwant\n%+v", got, tt.want)
+			}
+			if tt.urls == nil {
+				return
+			}
+			segments, err := templateSubstitution(info.Template.Media, info.Template, info.TemplateExt, r, m.periodDuration(period), discardLogger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var urls []string
+			for _, s := range segments {
+				urls = append(urls, s.URL)
+			}
+			if !reflect.DeepEqual(urls, tt.urls) {
+				t.Errorf("segment urls = %v, want %v", urls, tt.urls)
+			}
+		})
+	}
+}
+
+func TestMergeSegmentTemplatesDoesntModifyTheLevels(t *testing.T) {
+	media := "$Number$.m4s"
+	asTimescale, rTimescale := int64(1000), int64(90000)
+	asTemplate := &mpd.SegmentTemplate{Media: &media, Timescale: &asTimescale}
+	rTemplate := &mpd.SegmentTemplate{Timescale: &rTimescale}
+
+	merged := mergeSegmentTemplates(nil, asTemplate, rTemplate)
+	if *merged.Timescale != 90000 || strPtrtoS(merged.Media) != media {
+		t.Errorf("unexpected merged template %+v", merged)
+	}
+	start := int64(7)
+	merged.StartNumber = &start
+	if asTemplate.StartNumber != nil || rTemplate.StartNumber != nil {
+		t.Error("modifying the merged template modified an inherited level")
+	}
+}
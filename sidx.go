@@ -0,0 +1,115 @@
+package mpdgrabber
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/abema/go-mp4"
+)
+
+// sidxSegments turns the segment index (sidx box) of a SegmentBase
+// representation into byte range segments so the single file can be
+// downloaded concurrently and stitched back together.
+//
+// The first segment covers everything before the first subsegment
+// (ftyp, moov, sidx...) unless the initialization data lives in a separate
+// file, the following ones are the subsegments referenced by the index.
+func sidxSegments(ctx context.Context, client *http.Client, info *segmentInfo, baseURL *url.URL, urls *urlRewriter) ([]*Segment, error) {
+	if info == nil || info.Base == nil || info.Base.IndexRange == nil {
+		return nil, errors.New("no index range")
+	}
+	mediaURL := baseURL.String()
+	indexStart, _, err := parseByteRange(*info.Base.IndexRange)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := fetchRange(ctx, client, urls.apply(mediaURL), *info.Base.IndexRange)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch the index range %s - %w", *info.Base.IndexRange, err)
+	}
+
+	boxes, err := mp4.ExtractBoxWithPayload(bytes.NewReader(data), nil, mp4.BoxPath{mp4.BoxTypeSidx()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the index range %s - %w", *info.Base.IndexRange, err)
+	}
+	if len(boxes) == 0 {
+		return nil, fmt.Errorf("no sidx box found in the index range %s", *info.Base.IndexRange)
+	}
+	sidxBox := boxes[0]
+	sidx := sidxBox.Payload.(*mp4.Sidx)
+	if sidx.ReferenceCount == 0 || len(sidx.References) == 0 {
+		return nil, errors.New("empty sidx box")
+	}
+
+	timescale := uint64(sidx.Timescale)
+	if timescale == 0 {
+		timescale = uint64(uint32PtrToI(info.Base.Timescale))
+	}
+	var pto uint64
+	if info.Base.PresentationTimeOffset != nil {
+		pto = *info.Base.PresentationTimeOffset
+	}
+
+	// the offsets are relative to the first byte after the sidx box
+	anchor := indexStart + sidxBox.Info.Offset + sidxBox.Info.Size
+	offset := anchor + sidx.GetFirstOffset()
+
+	var segments []*Segment
+	if init := info.Base.Initialization; init != nil && init.SourceURL != nil && *init.SourceURL != "" {
+		segments = append(segments, &Segment{
+			URL:       resolveSegmentURL(baseURL, init.SourceURL),
+			ByteRange: strPtrtoEmpty(init.Range),
+			Init:      true,
+		})
+	} else if offset > 0 {
+		segments = append(segments, &Segment{
+			URL:       mediaURL,
+			ByteRange: fmt.Sprintf("0-%d", offset-1),
+			Init:      true,
+		})
+	}
+
+	ept := sidx.GetEarliestPresentationTime()
+	for i, ref := range sidx.References {
+		// a reference to another sidx box (hierarchical index) still covers
+		// a contiguous range of the file, we download it as a whole.
+		segments = append(segments, &Segment{
+			URL:       mediaURL,
+			ByteRange: fmt.Sprintf("%d-%d", offset, offset+uint64(ref.ReferencedSize)-1),
+			Number:    int64(i + 1),
+			Time:      ept,
+			Timescale: timescale,
+			Start:     timescaleDuration(int64(ept)-int64(pto), timescale),
+			Duration:  timescaleDuration(int64(ref.SubsegmentDuration), timescale),
+		})
+		offset += uint64(ref.ReferencedSize)
+		ept += uint64(ref.SubsegmentDuration)
+	}
+
+	return segments, nil
+}
+
+// parseByteRange parses a "first-last" byte range as found in the MPD.
+func parseByteRange(byteRange string) (first, last uint64, err error) {
+	firstStr, lastStr, ok := strings.Cut(strings.TrimSpace(byteRange), "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid byte range %q", byteRange)
+	}
+	if first, err = strconv.ParseUint(firstStr, 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("invalid byte range %q - %w", byteRange, err)
+	}
+	if last, err = strconv.ParseUint(lastStr, 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("invalid byte range %q - %w", byteRange, err)
+	}
+	if last < first {
+		return 0, 0, fmt.Errorf("invalid byte range %q", byteRange)
+	}
+	return first, last, nil
+}
@@ -0,0 +1,124 @@
+package mpdgrabber
+
+import (
+	"context"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/mattetti/go-dash/mpd"
+)
+
+// sidxReference is a reference of a hand built sidx box.
+type sidxReference struct {
+	sidx     bool
+	size     uint32
+	duration uint32
+}
+
+// buildSidx builds a version 0 sidx box.
+func buildSidx(timescale, ept, firstOffset uint32, refs []sidxReference) []byte {
+	box := make([]byte, 32+12*len(refs))
+	binary.BigEndian.PutUint32(box[0:], uint32(len(box)))
+	copy(box[4:], "sidx")
+	// version and flags are 0
+	binary.BigEndian.PutUint32(box[12:], 1) // reference_ID
+	binary.BigEndian.PutUint32(box[16:], timescale)
+	binary.BigEndian.PutUint32(box[20:], ept)
+	binary.BigEndian.PutUint32(box[24:], firstOffset)
+	binary.BigEndian.PutUint16(box[30:], uint16(len(refs)))
+	for i, ref := range refs {
+		entry := box[32+12*i:]
+		typeAndSize := ref.size
+		if ref.sidx {
+			typeAndSize |= 1 << 31
+		}
+		binary.BigEndian.PutUint32(entry[0:], typeAndSize)
+		binary.BigEndian.PutUint32(entry[4:], ref.duration)
+		binary.BigEndian.PutUint32(entry[8:], 1<<31) // starts_with_SAP
+	}
+	return box
+}
+
+func TestSidxSegments(t *testing.T) {
+	box := buildSidx(1000, 2000, 100, []sidxReference{
+		{size: 1000, duration: 2000},
+		{sidx: true, size: 500, duration: 2000},
+		{size: 1500, duration: 1000},
+	})
+	indexRange := "800-867"
+	if len(box) != 68 {
+		t.Fatalf("expected a 68 bytes sidx box, got %d", len(box))
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Range"); got != "bytes="+indexRange {
+			t.Errorf("expected the index range to be requested, got %q", got)
+		}
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(box)
+	}))
+	defer srv.Close()
+	baseURL, _ := url.Parse(srv.URL + "/video.mp4")
+	initURL, initRange := "init.mp4", "0-599"
+
+	tests := []struct {
+		name string
+		init *mpd.URL
+		want []Segment
+	}{
+		{
+			name: "init in the media file",
+			want: []Segment{
+				{ByteRange: "0-967", Init: true},
+				{ByteRange: "968-1967", Number: 1, Time: 2000, Start: time.Second, Duration: 2 * time.Second},
+				{ByteRange: "1968-2467", Number: 2, Time: 4000, Start: 3 * time.Second, Duration: 2 * time.Second},
+				{ByteRange: "2468-3967", Number: 3, Time: 6000, Start: 5 * time.Second, Duration: time.Second},
+			},
+		},
+		{
+			name: "separate init file",
+			init: &mpd.URL{SourceURL: &initURL, Range: &initRange},
+			want: []Segment{
+				{URL: srv.URL + "/init.mp4", ByteRange: "0-599", Init: true},
+				{ByteRange: "968-1967", Number: 1, Time: 2000, Start: time.Second, Duration: 2 * time.Second},
+				{ByteRange: "1968-2467", Number: 2, Time: 4000, Start: 3 * time.Second, Duration: 2 * time.Second},
+				{ByteRange: "2468-3967", Number: 3, Time: 6000, Start: 5 * time.Second, Duration: time.Second},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pto := uint64(1000)
+			info := &segmentInfo{Base: &mpd.SegmentBase{
+				IndexRange:             &indexRange,
+				PresentationTimeOffset: &pto,
+				Initialization:         tt.init,
+			}}
+			segments, err := sidxSegments(context.Background(), srv.Client(), info, baseURL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(segments) != len(tt.want) {
+				t.Fatalf("expected %d segments, got %d", len(tt.want), len(segments))
+			}
+			for i, want := range tt.want {
+				got := segments[i]
+				if want.URL == "" {
+					want.URL = baseURL.String()
+				}
+				if !want.Init {
+					want.Timescale = 1000
+				}
+				if got.URL != want.URL || got.ByteRange != want.ByteRange || got.Init != want.Init ||
+					got.Number != want.Number || got.Time != want.Time || got.Timescale != want.Timescale ||
+					got.Start != want.Start || got.Duration != want.Duration {
+					t.Errorf("segment %d: expected %+v, got %+v", i, want, *got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,288 @@
+package mpdgrabber
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// minTokenRefreshInterval limits how often the manifest is fetched again to
+// pick up fresh tokens, the segments downloaded concurrently usually expire
+// together.
+const minTokenRefreshInterval = 5 * time.Second
+
+// URLSigner is called when a request is rejected with a 401 or 403 status,
+// usually because the signed url expired. It returns the url to retry the
+// request with and/or the headers to add to the following requests.
+// An empty url means the url can't be signed again by the signer, the
+// manifest is then fetched again to pick up BaseURLs with fresh tokens.
+type URLSigner interface {
+	SignURL(rawURL string, statusCode int) (signedURL string, header http.Header, err error)
+}
+
+// URLSignerFunc adapts a function to the URLSigner interface.
+type URLSignerFunc func(rawURL string, statusCode int) (string, http.Header, error)
+
+func (f URLSignerFunc) SignURL(rawURL string, statusCode int) (string, http.Header, error) {
+	return f(rawURL, statusCode)
+}
+
+// isAuthStatus reports if the status means the url needs to be signed again.
+func isAuthStatus(statusCode int) bool {
+	return statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden
+}
+
+// urlSigning refreshes the urls of a job rejected by the server, through the
+// signer of the job or by fetching the manifest again.
+type urlSigning struct {
+	signer      URLSigner
+	client      *http.Client
+	manifestURL *url.URL
+	filter      *trackFilter
+
+	mu     sync.Mutex
+	header http.Header
+	// bases holds the current base urls of the selections, by selection
+	bases map[string][]string
+	// renewed maps the expired base urls to their latest version
+	renewed     map[string]string
+	lastRefresh time.Time
+	// refreshing is the manifest fetch in flight, shared by the requests
+	// rejected meanwhile
+	refreshing *manifestRefresh
+}
+
+// manifestRefresh is a fetch of the manifest for fresh urls, done is closed
+// once err is set.
+type manifestRefresh struct {
+	done chan struct{}
+	err  error
+}
+
+func newURLSigning(signer URLSigner, client *http.Client, manifestURL *url.URL, filter *trackFilter) *urlSigning {
+	return &urlSigning{
+		signer:      signer,
+		client:      client,
+		manifestURL: manifestURL,
+		filter:      filter,
+		bases:       map[string][]string{},
+		renewed:     map[string]string{},
+	}
+}
+
+// selectionID identifies a selected representation across manifest fetches.
+func selectionID(sel *trackSelection) string {
+	return sel.PeriodKey + "/" + sel.key() + "/" + strPtrtoS(sel.Representation.ID)
+}
+
+// register records the base urls of the selection, they are compared to the
+// ones of the refreshed manifest.
+func (s *urlSigning) register(sel *trackSelection) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := selectionID(sel)
+	if _, ok := s.bases[id]; !ok {
+		s.bases[id] = baseURLStrings(sel)
+	}
+}
+
+func baseURLStrings(sel *trackSelection) []string {
+	if len(sel.BaseURLs) == 0 {
+		return []string{sel.BaseURL.String()}
+	}
+	bases := make([]string, 0, len(sel.BaseURLs))
+	for _, b := range sel.BaseURLs {
+		bases = append(bases, b.URL.String())
+	}
+	return bases
+}
+
+// requestHeader returns the headers provided by the signer, nil if none.
+func (s *urlSigning) requestHeader() http.Header {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.header == nil {
+		return nil
+	}
+	return s.header.Clone()
+}
+
+// resign returns the url to retry a request rejected with statusCode.
+func (s *urlSigning) resign(ctx context.Context, rawURL string, statusCode int) (string, error) {
+	if s == nil {
+		return "", fmt.Errorf("no way to sign %s again", rawURL)
+	}
+	if s.signer != nil {
+		signedURL, header, err := s.signer.SignURL(rawURL, statusCode)
+		if err != nil {
+			return "", fmt.Errorf("failed to sign %s - %w", rawURL, err)
+		}
+		if len(header) > 0 {
+			s.mu.Lock()
+			if s.header == nil {
+				s.header = http.Header{}
+			}
+			for key, values := range header {
+				s.header[key] = values
+			}
+			s.mu.Unlock()
+		}
+		if signedURL != "" {
+			return signedURL, nil
+		}
+		if len(header) > 0 {
+			// the same url with the new headers
+			return rawURL, nil
+		}
+	}
+	return s.renewedURL(ctx, rawURL)
+}
+
+// renewedURL fetches the manifest again, if it wasn't just fetched, and
+// returns the url moved to the new version of its base url.
+func (s *urlSigning) renewedURL(ctx context.Context, rawURL string) (string, error) {
+	if err := s.refresh(ctx); err != nil {
+		return "", fmt.Errorf("failed to fetch the manifest again for fresh urls - %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if renewed := s.lookup(rawURL); renewed != rawURL {
+		return renewed, nil
+	}
+	return "", fmt.Errorf("no fresh url found for %s in the manifest", rawURL)
+}
+
+// refresh fetches the manifest again unless it was just fetched, the
+// requests rejected while the manifest is fetched wait for the same fetch.
+func (s *urlSigning) refresh(ctx context.Context) error {
+	s.mu.Lock()
+	r := s.refreshing
+	if r == nil {
+		if time.Since(s.lastRefresh) < minTokenRefreshInterval {
+			s.mu.Unlock()
+			return nil
+		}
+		s.lastRefresh = time.Now()
+		r = &manifestRefresh{done: make(chan struct{})}
+		s.refreshing = r
+		header := s.header.Clone()
+		s.mu.Unlock()
+
+		r.err = s.refreshManifest(ctx, header)
+		s.mu.Lock()
+		s.refreshing = nil
+		s.mu.Unlock()
+		close(r.done)
+		return r.err
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-r.done:
+		return r.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// current returns the url moved to the latest version of its base url, the
+// url is returned as is if its base url wasn't renewed.
+func (s *urlSigning) current(rawURL string) string {
+	if s == nil {
+		return rawURL
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lookup(rawURL)
+}
+
+func (s *urlSigning) lookup(rawURL string) string {
+	// the longest base url matching wins
+	olds := make([]string, 0, len(s.renewed))
+	for old := range s.renewed {
+		olds = append(olds, old)
+	}
+	sort.Slice(olds, func(i, j int) bool { return len(olds[i]) > len(olds[j]) })
+	for _, old := range olds {
+		oldURL, err := url.Parse(old)
+		if err != nil {
+			continue
+		}
+		newURL, err := url.Parse(s.renewed[old])
+		if err != nil {
+			continue
+		}
+		if renewed, ok := mirrorURL(rawURL, oldURL, newURL); ok {
+			return renewed
+		}
+	}
+	return rawURL
+}
+
+// refreshManifest fetches and parses the manifest again and records how the
+// base urls of the selections changed.
+func (s *urlSigning) refreshManifest(ctx context.Context, header http.Header) error {
+	log := loggerFrom(ctx)
+	log.Debug("fetching the manifest again for fresh urls", "url", s.manifestURL.String())
+	data, err := fetch(ctx, s.client, s.manifestURL.String(), "", header, true)
+	if err != nil {
+		return err
+	}
+	m, err := parseManifest(ctx, s.client, data, s.manifestURL)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sel := range selectTracks(m, s.manifestURL, s.filter, log) {
+		id := selectionID(sel)
+		previous, ok := s.bases[id]
+		if !ok {
+			continue
+		}
+		current := baseURLStrings(sel)
+		n := len(current)
+		if n != len(previous) {
+			// can't tell which alternative became which, only the primary
+			// one is matched
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			if current[i] == previous[i] {
+				continue
+			}
+			log.Debug("base url renewed", "url", previous[i], "renewed", current[i])
+			// urls already renewed point to the latest version
+			for old, renewed := range s.renewed {
+				if renewed == previous[i] {
+					s.renewed[old] = current[i]
+				}
+			}
+			s.renewed[previous[i]] = current[i]
+			previous[i] = current[i]
+		}
+	}
+	return nil
+}
+
+// retryableAuthError returns the status error if err is a 401 or 403 response.
+func retryableAuthError(err error) (*httpStatusError, bool) {
+	var statusErr *httpStatusError
+	if !errors.As(err, &statusErr) || !isAuthStatus(statusErr.StatusCode) {
+		return nil, false
+	}
+	return statusErr, true
+}
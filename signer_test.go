@@ -0,0 +1,93 @@
+package mpdgrabber
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func signerTestManifest(token string) string {
+	return fmt.Sprintf(`<?xml version="1.0"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static" mediaPresentationDuration="PT10S">
+  <BaseURL>https://cdn.example.com/%s/</BaseURL>
+  <Period id="0">
+    <AdaptationSet mimeType="video/mp4"><SegmentTemplate media="seg_$Number$.m4s" duration="2" timescale="1"/><Representation id="v" bandwidth="1000"/></AdaptationSet>
+  </Period>
+</MPD>`, token)
+}
+
+func TestURLSigningSharesTheManifestRefresh(t *testing.T) {
+	release := make(chan struct{})
+	var fetches int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		w.Write([]byte(signerTestManifest("token2")))
+	}))
+	defer srv.Close()
+
+	manifestURL, _ := url.Parse(srv.URL + "/manifest.mpd")
+	m, err := readManifest([]byte(signerTestManifest("token1")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter := newTrackFilter(nil, nil)
+	signing := newURLSigning(nil, srv.Client(), manifestURL, filter)
+	for _, sel := range selectTracks(m, manifestURL, filter, discardLogger) {
+		signing.register(sel)
+	}
+	ctx := context.Background()
+
+	const rejected = 5
+	var wg sync.WaitGroup
+	renewed := make([]string, rejected)
+	errs := make([]error, rejected)
+	for i := 0; i < rejected; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			renewed[i], errs[i] = signing.renewedURL(ctx, fmt.Sprintf("https://cdn.example.com/token1/seg_%d.m4s", i+1))
+		}(i)
+	}
+
+	// the signing isn't locked while the manifest is fetched
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&fetches) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	current := make(chan string)
+	go func() { current <- signing.current("https://cdn.example.com/token1/seg_9.m4s") }()
+	select {
+	case <-current:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the urls can't be read while the manifest is fetched")
+	}
+	// and the requests waiting for the fetch stop with their context
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := signing.renewedURL(cancelled, "https://cdn.example.com/token1/seg_9.m4s"); !errors.Is(err, context.Canceled) {
+		t.Errorf("renewedURL() with a cancelled context = %v, want %v", err, context.Canceled)
+	}
+
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("the manifest was fetched %d times, want 1", n)
+	}
+	for i := range renewed {
+		if errs[i] != nil {
+			t.Errorf("renewedURL() = %v", errs[i])
+			continue
+		}
+		if want := fmt.Sprintf("https://cdn.example.com/token2/seg_%d.m4s", i+1); renewed[i] != want {
+			t.Errorf("renewedURL() = %s, want %s", renewed[i], want)
+		}
+	}
+}
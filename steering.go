@@ -0,0 +1,182 @@
+package mpdgrabber
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultSteeringTTL is used when the steering manifest doesn't set a TTL.
+const defaultSteeringTTL = 300 * time.Second
+
+// steeringManifest is the JSON document returned by the content steering
+// server (ETSI TS 103 998 / DASH-IF Content Steering).
+type steeringManifest struct {
+	Version         int      `json:"VERSION"`
+	TTL             int      `json:"TTL"`
+	ReloadURI       string   `json:"RELOAD-URI"`
+	PathwayPriority []string `json:"PATHWAY-PRIORITY"`
+}
+
+// contentSteering ranks the service locations (pathways) of the BaseURLs
+// following the priority published by the steering server, the steering
+// manifest is polled again when its TTL expires.
+type contentSteering struct {
+	mu       sync.RWMutex
+	client   *http.Client
+	uri      *url.URL
+	priority []string
+	ttl      time.Duration
+	// queryBeforeStart makes the download wait for the steering manifest,
+	// it's fetched in the background otherwise.
+	queryBeforeStart bool
+	stop             chan struct{}
+	log              *slog.Logger
+}
+
+// newContentSteering returns nil if the manifest doesn't use content
+// steering. The ContentSteering@defaultServiceLocation is used until the
+// steering server responds.
+func newContentSteering(client *http.Client, m *manifest, manifestURL *url.URL, log *slog.Logger) *contentSteering {
+	if m.ext == nil || m.ext.ContentSteering == nil {
+		return nil
+	}
+	el := m.ext.ContentSteering
+	uri := strings.TrimSpace(el.URL)
+	if uri == "" {
+		return nil
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		log.Warn("invalid content steering url", "url", uri, "err", err)
+		return nil
+	}
+	return &contentSteering{
+		client:           client,
+		uri:              manifestURL.ResolveReference(u),
+		priority:         strings.Fields(strPtrtoEmpty(el.DefaultServiceLocation)),
+		ttl:              defaultSteeringTTL,
+		queryBeforeStart: el.QueryBeforeStart != nil && *el.QueryBeforeStart,
+		stop:             make(chan struct{}),
+		log:              log,
+	}
+}
+
+// start fetches the steering manifest, before returning if
+// ContentSteering@queryBeforeStart is set, and keeps polling it in the
+// background until close is called or ctx is done.
+func (s *contentSteering) start(ctx context.Context) {
+	if s == nil {
+		return
+	}
+	if !s.queryBeforeStart {
+		go s.poll(ctx, 0)
+		return
+	}
+	if err := s.update(ctx); err != nil {
+		s.log.Warn("failed to fetch the content steering manifest", "err", err)
+	}
+	s.mu.RLock()
+	ttl := s.ttl
+	s.mu.RUnlock()
+	go s.poll(ctx, ttl)
+}
+
+// poll fetches the steering manifest after delay then each time its TTL
+// expires.
+func (s *contentSteering) poll(ctx context.Context, delay time.Duration) {
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if err := s.update(ctx); err != nil {
+			// the previous priority stays in effect
+			s.log.Warn("failed to refresh the content steering manifest", "err", err)
+		}
+		s.mu.RLock()
+		delay = s.ttl
+		s.mu.RUnlock()
+	}
+}
+
+func (s *contentSteering) close() {
+	if s == nil {
+		return
+	}
+	close(s.stop)
+}
+
+// update fetches the steering manifest, reporting the pathway in use.
+func (s *contentSteering) update(ctx context.Context) error {
+	s.mu.RLock()
+	reqURL := *s.uri
+	if len(s.priority) > 0 {
+		query := reqURL.Query()
+		query.Set("_DASH_pathway", `"`+s.priority[0]+`"`)
+		reqURL.RawQuery = query.Encode()
+	}
+	s.mu.RUnlock()
+
+	s.log.Debug("fetching the content steering manifest", "url", reqURL.String())
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad status: %s", resp.Status)
+	}
+	steering := &steeringManifest{}
+	if err := json.NewDecoder(resp.Body).Decode(steering); err != nil {
+		return fmt.Errorf("invalid steering manifest - %w", err)
+	}
+	if steering.Version != 1 {
+		return fmt.Errorf("unsupported steering manifest version %d", steering.Version)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(steering.PathwayPriority) > 0 {
+		s.priority = steering.PathwayPriority
+	}
+	if steering.TTL > 0 {
+		s.ttl = time.Duration(steering.TTL) * time.Second
+	}
+	if steering.ReloadURI != "" {
+		if u, err := url.Parse(steering.ReloadURI); err == nil {
+			s.uri = s.uri.ResolveReference(u)
+		}
+	}
+	s.log.Debug("content steering pathway priority", "priority", strings.Join(s.priority, ", "), "ttl", s.ttl)
+	return nil
+}
+
+// rank returns the position of the service location in the pathway
+// priority, locations not listed come last.
+func (s *contentSteering) rank(serviceLocation string) int {
+	if s == nil {
+		return 0
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for i, pathway := range s.priority {
+		if pathway == serviceLocation {
+			return i
+		}
+	}
+	return len(s.priority)
+}
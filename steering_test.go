@@ -0,0 +1,151 @@
+package mpdgrabber
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// steeringRequest is a request received by the test steering server.
+type steeringRequest struct {
+	path    string
+	pathway string
+}
+
+func steeringTestManifest(t *testing.T, steeringURL string, queryBeforeStart bool) *manifest {
+	t.Helper()
+	m, err := readManifest([]byte(fmt.Sprintf(`<?xml version="1.0"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static" mediaPresentationDuration="PT10S">
+  <BaseURL serviceLocation="alpha">https://alpha.example.com/</BaseURL>
+  <BaseURL serviceLocation="beta">https://beta.example.com/</BaseURL>
+  <ContentSteering defaultServiceLocation="alpha" queryBeforeStart="%t">%s</ContentSteering>
+  <Period id="0"/>
+</MPD>`, queryBeforeStart, steeringURL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func steeringTestHosts(steering *contentSteering) *hostHealth {
+	hosts := newHostHealth()
+	hosts.locations["alpha.example.com"] = "alpha"
+	hosts.locations["beta.example.com"] = "beta"
+	hosts.steering = steering
+	return hosts
+}
+
+var steeringTestURLs = []string{"https://alpha.example.com/seg_1.m4s", "https://beta.example.com/seg_1.m4s"}
+
+func TestContentSteeringReordersAndReloads(t *testing.T) {
+	requests := make(chan steeringRequest, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- steeringRequest{path: r.URL.Path, pathway: r.URL.Query().Get("_DASH_pathway")}
+		switch r.URL.Path {
+		case "/steering":
+			fmt.Fprint(w, `{"VERSION": 1, "TTL": 1, "RELOAD-URI": "/steering/reload?session=1", "PATHWAY-PRIORITY": ["beta", "alpha"]}`)
+		case "/steering/reload":
+			if r.URL.Query().Get("session") != "1" {
+				http.Error(w, "missing session", http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, `{"VERSION": 1, "TTL": 300, "PATHWAY-PRIORITY": ["alpha", "beta"]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	manifestURL, _ := url.Parse(srv.URL + "/manifest.mpd")
+	steering := newContentSteering(srv.Client(), steeringTestManifest(t, "/steering", true), manifestURL, discardLogger)
+	if steering == nil || !steering.queryBeforeStart {
+		t.Fatal("the content steering wasn't set up")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	steering.start(ctx)
+	defer steering.close()
+
+	// queryBeforeStart: the steering manifest was fetched before start returned
+	select {
+	case req := <-requests:
+		if req.path != "/steering" || req.pathway != `"alpha"` {
+			t.Errorf("unexpected first request %+v", req)
+		}
+	default:
+		t.Fatal("the steering manifest wasn't fetched before starting")
+	}
+	hosts := steeringTestHosts(steering)
+	want := []string{steeringTestURLs[1], steeringTestURLs[0]}
+	if got := hosts.order(steeringTestURLs); !reflect.DeepEqual(got, want) {
+		t.Errorf("order() = %v, want %v", got, want)
+	}
+
+	// the TTL expires, the RELOAD-URI is polled reporting the pathway in use
+	select {
+	case req := <-requests:
+		if req.path != "/steering/reload" || req.pathway != `"beta"` {
+			t.Errorf("unexpected reload request %+v", req)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the steering manifest wasn't polled again once its TTL expired")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for steering.rank("alpha") != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := hosts.order(steeringTestURLs); !reflect.DeepEqual(got, steeringTestURLs) {
+		t.Errorf("order() after the reload = %v, want %v", got, steeringTestURLs)
+	}
+}
+
+func TestContentSteeringInBackground(t *testing.T) {
+	release := make(chan struct{})
+	fetched := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		fmt.Fprint(w, `{"VERSION": 1, "TTL": 300, "PATHWAY-PRIORITY": ["beta", "alpha"]}`)
+		close(fetched)
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	manifestURL, _ := url.Parse(srv.URL + "/manifest.mpd")
+	steering := newContentSteering(srv.Client(), steeringTestManifest(t, "/steering", false), manifestURL, discardLogger)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	started := make(chan struct{})
+	go func() {
+		steering.start(ctx)
+		close(started)
+	}()
+	select {
+	case <-started:
+	case <-time.After(2 * time.Second):
+		t.Fatal("start waited for the steering server without queryBeforeStart")
+	}
+	defer steering.close()
+
+	// the default service location is used until the server responds
+	hosts := steeringTestHosts(steering)
+	if got := hosts.order(steeringTestURLs); !reflect.DeepEqual(got, steeringTestURLs) {
+		t.Errorf("order() before the steering manifest = %v, want %v", got, steeringTestURLs)
+	}
+
+	release <- struct{}{}
+	<-fetched
+	deadline := time.Now().Add(2 * time.Second)
+	for steering.rank("beta") != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	want := []string{steeringTestURLs[1], steeringTestURLs[0]}
+	if got := hosts.order(steeringTestURLs); !reflect.DeepEqual(got, want) {
+		t.Errorf("order() after the steering manifest = %v, want %v", got, want)
+	}
+}
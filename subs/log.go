@@ -0,0 +1,13 @@
+package subs
+
+import "log/slog"
+
+// Logger receives the logs of the package, slog.Default() is used if nil.
+var Logger *slog.Logger
+
+func logger() *slog.Logger {
+	if Logger != nil {
+		return Logger
+	}
+	return slog.Default()
+}
@@ -3,7 +3,6 @@ package subs
 import (
 	"bytes"
 	"encoding/xml"
-	"fmt"
 	"io"
 	"io/ioutil"
 	"strings"
@@ -100,7 +99,7 @@ func (s *Style) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 		}
 		switch element := token.(type) {
 		case xml.StartElement:
-			fmt.Println("****", element.Name.Local)
+			logger().Debug("ttml element", "element", element.Name.Local)
 
 		}
 	}
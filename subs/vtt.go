@@ -261,7 +261,7 @@ func ExtractAtomWebVTT(buf []byte) ([]VTTCueBoxContent, error) {
 		// if vttc, parse the cue box
 		if bytes.Equal(boxType, []byte("vttc")) {
 			if r.Len() < int(boxHeaderSize) {
-				fmt.Println("vttc box too small")
+				logger().Debug("vttc box too small", "size", r.Len())
 				break
 			}
 			err = binary.Read(r, binary.BigEndian, &boxSize)
@@ -277,7 +277,7 @@ func ExtractAtomWebVTT(buf []byte) ([]VTTCueBoxContent, error) {
 				data = append(data, boxdata...)
 				cues = append(cues, VTTCueBoxContent{Size: int(boxSize), Content: string(boxdata)})
 			} else {
-				fmt.Println("can't process box type: ", string(boxType))
+				logger().Debug("can't process the box type, skipping it", "box", string(boxType))
 				// skip
 				r.Seek(int64(boxSize-boxHeaderSize), io.SeekCurrent)
 			}
@@ -0,0 +1,148 @@
+package mpdgrabber
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Template identifiers as defined in ISO/IEC 23009-1 §5.3.9.4.4
+const (
+	identRepresentationID = "RepresentationID"
+	identNumber           = "Number"
+	identBandwidth        = "Bandwidth"
+	identTime             = "Time"
+	identSubNumber        = "SubNumber"
+)
+
+// templateVars holds the values substituted in a SegmentTemplate string.
+type templateVars struct {
+	RepresentationID string
+	Number           int64
+	Bandwidth        int64
+	Time             uint64
+	SubNumber        int64
+}
+
+// templateToken is either a literal string or an identifier with an
+// optional printf-style width (%0[width]d).
+type templateToken struct {
+	literal string
+	ident   string
+	width   int
+}
+
+// segmentURLTemplate is a parsed @media, @initialization, @index or
+// @bitstreamSwitching template.
+type segmentURLTemplate struct {
+	raw    string
+	tokens []templateToken
+}
+
+// parseTemplate tokenizes a SegmentTemplate string.
+// $$ is an escaped $, identifiers are wrapped in $ and can carry a format tag
+// except for $RepresentationID$.
+func parseTemplate(tmpl string) (*segmentURLTemplate, error) {
+	t := &segmentURLTemplate{raw: tmpl}
+	var literal strings.Builder
+	for i := 0; i < len(tmpl); i++ {
+		if tmpl[i] != '$' {
+			literal.WriteByte(tmpl[i])
+			continue
+		}
+		end := strings.IndexByte(tmpl[i+1:], '$')
+		if end < 0 {
+			return nil, fmt.Errorf("invalid template %q: unterminated identifier at offset %d", tmpl, i)
+		}
+		end += i + 1
+		// $$ escape sequence
+		if end == i+1 {
+			literal.WriteByte('$')
+			i = end
+			continue
+		}
+
+		token, err := parseIdentifier(tmpl[i+1 : end])
+		if err != nil {
+			return nil, fmt.Errorf("invalid template %q: %w", tmpl, err)
+		}
+		if literal.Len() > 0 {
+			t.tokens = append(t.tokens, templateToken{literal: literal.String()})
+			literal.Reset()
+		}
+		t.tokens = append(t.tokens, token)
+		i = end
+	}
+	if literal.Len() > 0 {
+		t.tokens = append(t.tokens, templateToken{literal: literal.String()})
+	}
+	return t, nil
+}
+
+func parseIdentifier(s string) (templateToken, error) {
+	name, format, hasFormat := strings.Cut(s, "%")
+	token := templateToken{ident: name}
+	switch name {
+	case identRepresentationID:
+		if hasFormat {
+			return token, fmt.Errorf("$%s$ doesn't support format tags", name)
+		}
+	case identNumber, identBandwidth, identTime, identSubNumber:
+	default:
+		return token, fmt.Errorf("unknown identifier $%s$", s)
+	}
+	if !hasFormat {
+		return token, nil
+	}
+
+	// the only format tag allowed is %0[width]d
+	if len(format) < 3 || format[0] != '0' || format[len(format)-1] != 'd' {
+		return token, fmt.Errorf("invalid format tag %%%s for $%s$, expected %%0[width]d", format, name)
+	}
+	width, err := strconv.Atoi(format[1 : len(format)-1])
+	if err != nil || width < 1 {
+		return token, fmt.Errorf("invalid width in format tag %%%s for $%s$", format, name)
+	}
+	token.width = width
+	return token, nil
+}
+
+// uses reports if the template references the passed identifier.
+func (t *segmentURLTemplate) uses(ident string) bool {
+	for _, token := range t.tokens {
+		if token.ident == ident {
+			return true
+		}
+	}
+	return false
+}
+
+// expand substitutes the identifiers with the passed values.
+func (t *segmentURLTemplate) expand(vars templateVars) string {
+	var out strings.Builder
+	for _, token := range t.tokens {
+		if token.ident == "" {
+			out.WriteString(token.literal)
+			continue
+		}
+		var value string
+		switch token.ident {
+		case identRepresentationID:
+			out.WriteString(vars.RepresentationID)
+			continue
+		case identNumber:
+			value = strconv.FormatInt(vars.Number, 10)
+		case identBandwidth:
+			value = strconv.FormatInt(vars.Bandwidth, 10)
+		case identTime:
+			value = strconv.FormatUint(vars.Time, 10)
+		case identSubNumber:
+			value = strconv.FormatInt(vars.SubNumber, 10)
+		}
+		if pad := token.width - len(value); pad > 0 {
+			out.WriteString(strings.Repeat("0", pad))
+		}
+		out.WriteString(value)
+	}
+	return out.String()
+}
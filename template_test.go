@@ -0,0 +1,93 @@
+package mpdgrabber
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseTemplate(t *testing.T) {
+	vars := templateVars{
+		RepresentationID: "video_1",
+		Number:           42,
+		Bandwidth:        800000,
+		Time:             1234567,
+		SubNumber:        3,
+	}
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{"literal", "init.mp4", "init.mp4"},
+		{"representation id", "$RepresentationID$/init.mp4", "video_1/init.mp4"},
+		{"number", "seg_$Number$.m4s", "seg_42.m4s"},
+		{"padded number", "seg_$Number%05d$.m4s", "seg_00042.m4s"},
+		{"width narrower than the value", "seg_$Number%01d$.m4s", "seg_42.m4s"},
+		{"time", "$Time$.m4s", "1234567.m4s"},
+		{"padded time", "$Time%010d$.m4s", "0001234567.m4s"},
+		{"bandwidth", "$Bandwidth$/$Number$.m4s", "800000/42.m4s"},
+		{"sub number", "$Number$_$SubNumber%02d$.m4s", "42_03.m4s"},
+		{"escaped dollar", "price$$_$Number$.m4s", "price$_42.m4s"},
+		{"escaped dollars only", "$$$$", "$$"},
+		{"escape next to an identifier", "$$$Number$$$", "$42$"},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := parseTemplate(tt.template)
+			if err != nil {
+				t.Fatalf("parseTemplate(%q) failed - %v", tt.template, err)
+			}
+			if got := tmpl.expand(vars); got != tt.want {
+				t.Errorf("expand(%q) = %q, want %q", tt.template, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTemplateErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		errMsg   string
+	}{
+		{"unterminated identifier", "seg_$Number.m4s", "unterminated identifier at offset 4"},
+		{"trailing dollar", "seg_$Number$.m4s$", "unterminated identifier"},
+		{"unknown identifier", "seg_$Index$.m4s", "unknown identifier $Index$"},
+		{"identifiers are case sensitive", "seg_$number$.m4s", "unknown identifier $number$"},
+		{"representation id with a format tag", "$RepresentationID%05d$.m4s", "doesn't support format tags"},
+		{"format tag without padding", "$Number%5d$.m4s", "invalid format tag %5d"},
+		{"format tag with another verb", "$Number%05x$.m4s", "invalid format tag %05x"},
+		{"format tag without width", "$Number%0d$.m4s", "invalid format tag %0d"},
+		{"zero width", "$Number%00d$.m4s", "invalid width"},
+		{"non numeric width", "$Number%0ad$.m4s", "invalid width"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseTemplate(tt.template)
+			if err == nil {
+				t.Fatalf("parseTemplate(%q) should have failed", tt.template)
+			}
+			if !strings.Contains(err.Error(), tt.errMsg) {
+				t.Errorf("parseTemplate(%q) error = %q, want it to contain %q", tt.template, err, tt.errMsg)
+			}
+		})
+	}
+}
+
+func TestTemplateUses(t *testing.T) {
+	tmpl, err := parseTemplate("$RepresentationID$/$$Time$$_$Number%03d$.m4s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tmpl.uses(identNumber) {
+		t.Error("the template should use $Number$")
+	}
+	if !tmpl.uses(identRepresentationID) {
+		t.Error("the template should use $RepresentationID$")
+	}
+	// $$Time$$ is the literal "$Time$"
+	if tmpl.uses(identTime) {
+		t.Error("the template shouldn't use $Time$")
+	}
+}
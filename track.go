@@ -0,0 +1,572 @@
+package mpdgrabber
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattetti/go-dash/mpd"
+)
+
+// trackSelection is a representation picked for download.
+type trackSelection struct {
+	Period         *mpd.Period
+	AdaptationSet  *mpd.AdaptationSet
+	Representation *mpd.Representation
+	// BaseURL is the resolved base url of the representation, the preferred
+	// one of BaseURLs.
+	BaseURL     *url.URL
+	BaseURLs    []*baseURL
+	ContentType string
+	// PeriodKey identifies the period, Period@id or its position
+	PeriodKey string
+}
+
+// key identifies the track across periods and manifest refreshes.
+func (t *trackSelection) key() string {
+	as := t.AdaptationSet
+	return fmt.Sprintf("%s-%s-%s", t.ContentType, strPtrtoS(as.ID), strPtrtoS(as.Lang))
+}
+
+// selectTracks picks the best representation of each adaptation set matching
+// the content type and language filters, period by period.
+func selectTracks(m *manifest, manifestURL *url.URL, filter *trackFilter, log *slog.Logger) []*trackSelection {
+	var tracks []*trackSelection
+
+	// all the alternative locations are resolved, the first one being the
+	// preferred one.
+	manifestBases := []*baseURL{{URL: manifestURL, Priority: defaultBaseURLPriority, Weight: defaultBaseURLWeight}}
+	mpdBases := resolveBaseURLs(manifestBases, m.baseURLsOf(m.MPD, m.BaseURL), log)
+	if len(m.BaseURL) > 0 {
+		log.Debug("manifest base url", "url", mpdBases[0].URL.String())
+	}
+
+	for i, period := range m.Periods {
+		periodKey := periodKey(period, i)
+		log.Debug("period", "period", period.ID, "duration", time.Duration(period.Duration))
+
+		periodBases := resolveBaseURLs(mpdBases, m.baseURLsOf(period, period.BaseURL), log)
+		if len(period.BaseURL) > 0 {
+			log.Debug("period base url", "period", periodKey, "url", periodBases[0].URL.String())
+		}
+
+		for _, adaptationSet := range period.AdaptationSets {
+			contentType := extractContentType(adaptationSet.ContentType, adaptationSet.MimeType)
+			if contentType == UnknownString {
+				availableTypes := representationTypes(adaptationSet.Representations)
+				if len(availableTypes) == 1 {
+					contentType = availableTypes[0]
+				}
+			}
+			setBases := resolveBaseURLs(periodBases, m.baseURLsOf(adaptationSet, adaptationSet.BaseURL), log)
+			setBaseURL := setBases[0].URL
+			// populate the adaptation set in the representation
+			for i := range adaptationSet.Representations {
+				adaptationSet.Representations[i].AdaptationSet = adaptationSet
+			}
+
+			if filter.skipLang(strPtrtoS(adaptationSet.Lang)) {
+				log.Debug("skipping adaptation set, language filtered out",
+					"adaptation_set", strPtrtoS(adaptationSet.ID),
+					"content_type", contentType,
+					"lang", strPtrtoS(adaptationSet.Lang),
+					"allowed", strings.Join(filter.langs, ","),
+				)
+				continue
+			}
+
+			if filter.skipContentType(contentType) {
+				log.Debug("skipping adaptation set, content type filtered out",
+					"adaptation_set", strPtrtoS(adaptationSet.ID),
+					"content_type", contentType,
+					"allowed", strings.Join(filter.allowedContentTypes(), ","),
+				)
+				continue
+			}
+
+			debugLogAdaptationSet(log, setBaseURL, contentType, adaptationSet)
+
+			r := highestRepresentation(contentType, adaptationSet.Representations, log)
+			if r == nil {
+				log.Warn("no representation found for adaptation set", "adaptation_set", strPtrtoS(adaptationSet.ID))
+				continue
+			}
+			debugLogRepresentation(log.With("best", true), m, period, setBaseURL, contentType, r)
+
+			bases := orderBaseURLs(resolveBaseURLs(setBases, m.baseURLsOf(r, r.BaseURL), log))
+			if len(bases) > 1 {
+				for _, b := range bases[1:] {
+					log.Debug("alternative base url", "representation", strPtrtoS(r.ID), "url", b.URL.String(), "service_location", b.ServiceLocation, "priority", b.Priority, "weight", b.Weight)
+				}
+			}
+			tracks = append(tracks, &trackSelection{
+				Period:         period,
+				AdaptationSet:  adaptationSet,
+				Representation: r,
+				BaseURL:        bases[0].URL,
+				BaseURLs:       bases,
+				ContentType:    contentType,
+				PeriodKey:      periodKey,
+			})
+		}
+	}
+
+	return tracks
+}
+
+// periodContinuityScheme signals that an adaptation set continues the
+// adaptation set with the same id in the period referenced by the value.
+const periodContinuityScheme = "urn:mpeg:dash:period-continuity:2015"
+
+// trackGroup is a track spanning multiple periods, the selections are in
+// period order.
+type trackGroup struct {
+	key     string
+	asID    string
+	tracks  []*trackSelection
+	periods map[string]bool
+}
+
+// trackGroups matches the adaptation sets of consecutive periods so their
+// segments can be concatenated into one continuous track.
+type trackGroups struct {
+	groups []*trackGroup
+	// assigned remembers the grouped adaptation sets so the selections of a
+	// refreshed manifest land in the same groups.
+	assigned map[string]*trackGroup
+	log      *slog.Logger
+}
+
+func newTrackGroups(log *slog.Logger) *trackGroups {
+	return &trackGroups{assigned: map[string]*trackGroup{}, log: log}
+}
+
+// add places the selection in the group of the matching adaptation set of
+// a previous period, or in a new group.
+// Adaptation sets are matched using the period continuity descriptor first
+// then by content type, id and language.
+func (g *trackGroups) add(sel *trackSelection) *trackGroup {
+	asID := strPtrtoEmpty(sel.AdaptationSet.ID)
+	assignedKey := sel.PeriodKey + "/" + sel.key()
+	if group, ok := g.assigned[assignedKey]; ok {
+		return group
+	}
+
+	var match *trackGroup
+	if prevPeriod := continuedPeriod(sel.AdaptationSet); prevPeriod != "" && asID != "" {
+		for _, group := range g.groups {
+			if group.asID == asID && group.periods[prevPeriod] && !group.periods[sel.PeriodKey] {
+				match = group
+				break
+			}
+		}
+	}
+	if match == nil {
+		for _, group := range g.groups {
+			if group.key == sel.key() && !group.periods[sel.PeriodKey] {
+				match = group
+				break
+			}
+		}
+	}
+	if match == nil {
+		match = &trackGroup{key: sel.key(), asID: asID, periods: map[string]bool{}}
+		g.groups = append(g.groups, match)
+	} else {
+		g.log.Debug("adaptation set continues a track", "period", sel.PeriodKey, "adaptation_set", asID, "track", match.key)
+	}
+
+	match.tracks = append(match.tracks, sel)
+	match.periods[sel.PeriodKey] = true
+	g.assigned[assignedKey] = match
+	return match
+}
+
+// continues reports if the selection continues the previous period of its
+// track according to the period continuity descriptor, the segments of both
+// periods can then be concatenated as is.
+func (t *trackSelection) continues(prev *trackSelection) bool {
+	return prev != nil && continuedPeriod(t.AdaptationSet) == prev.PeriodKey
+}
+
+// continuedPeriod returns the id of the period the adaptation set continues
+// according to its period continuity descriptor.
+func continuedPeriod(as *mpd.AdaptationSet) string {
+	for _, props := range [][]mpd.DescriptorType{as.SupplementalProperty, as.EssentialProperty} {
+		for _, prop := range props {
+			if strPtrtoEmpty(prop.SchemeIDURI) == periodContinuityScheme {
+				return strings.TrimSpace(strPtrtoEmpty(prop.Value))
+			}
+		}
+	}
+	return ""
+}
+
+// representationSegments lists the segments of a representation whatever
+// its addressing scheme, the initialization segment first. The urls are
+// rewritten following the query policy of the job.
+func representationSegments(ctx context.Context, client *http.Client, m *manifest, period *mpd.Period, baseURL *url.URL, r *mpd.Representation, urls *urlRewriter) ([]*Segment, error) {
+	log := loggerFrom(ctx)
+	info := resolveSegmentInfo(m, period, r.AdaptationSet, r)
+	log.Debug("segment addressing", "representation", strPtrtoS(r.ID), "addressing", info.Addressing)
+
+	var segments []*Segment
+	var err error
+	switch info.Addressing {
+	case addressingBase:
+		// an indexed single file can still be downloaded concurrently using
+		// the byte ranges of its subsegments
+		if info.Base.IndexRange != nil {
+			segments, err = sidxSegments(ctx, client, info, baseURL, urls)
+			if err != nil || len(segments) == 0 {
+				log.Warn("can't use the segment index, downloading the representation as a single file", "representation", strPtrtoS(r.ID), "err", err)
+				segments, err = nil, nil
+			}
+		}
+		if len(segments) == 0 {
+			// 1 big file for the entire representation
+			segments = []*Segment{{URL: baseURL.String(), Duration: m.periodDuration(period)}}
+		}
+	case addressingList:
+		// raw segment list
+		segments, err = listSegments(info, m.periodDuration(period), baseURL, r, log)
+	case addressingTemplate:
+		// templated segment list
+		segments, err = templatedSegments(info, m.periodDuration(period), baseURL, r, log)
+	default:
+		asID := UnknownString
+		if r.AdaptationSet != nil {
+			asID = strPtrtoS(r.AdaptationSet.ID)
+		}
+		return nil, fmt.Errorf("track is not in a supported format, AS ID: %s, Rep ID: %s - %w", asID, strPtrtoS(r.ID), ErrUnsupportedManifest)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	urls.applySegments(segments)
+	return segments, nil
+}
+
+// trackDownload queues the segments of a track on the segment workers and
+// reassembles them once they are all downloaded.
+type trackDownload struct {
+	r       *mpd.Representation
+	cType   ContentType
+	baseURL *url.URL
+	// single is set when the track is made of one file, not segments
+	single bool
+	// prefix is added to the temporary filenames to avoid collisions
+	prefix string
+	// hosts tracks the failing hosts of the job
+	hosts *hostHealth
+	// signing renews the urls rejected by the server
+	signing *urlSigning
+	client  *http.Client
+	retry   *RetryOptions
+	// sizeTolerance is the Options.SegmentSizeTolerance of the job
+	sizeTolerance float64
+	// workspace holds the segments, the ones downloaded by a previous run
+	// are reused
+	workspace *workspace
+	// segments is the queue of the segment workers
+	segments chan<- *WJob
+	// ctx stops the download, no more segments are queued once it's done
+	ctx context.Context
+	// events reports the progress of the track described by info
+	events *jobEvents
+	info   TrackInfo
+	log    *slog.Logger
+
+	filenamePattern string
+	jobs            []*WJob
+	wg              *sync.WaitGroup
+
+	// parts are the runs of segments reassembled separately, a period that
+	// doesn't continue the previous one starts a new part.
+	parts []*trackPart
+	// lastInit is the initialization segment of the last part
+	lastInit string
+	// newPart is set when the next segments start a new part
+	newPart bool
+}
+
+// trackPart is a run of segments that can be concatenated as is: the
+// periods share their initialization segment and their timing continues.
+type trackPart struct {
+	// pattern prefixes the filenames of the segments of the part
+	pattern  string
+	jobs     int
+	duration time.Duration
+}
+
+const segmentSuffix = "_seg_"
+
+func newTrackDownload(r *mpd.Representation, cType ContentType, baseURL *url.URL) *trackDownload {
+	return &trackDownload{
+		r:       r,
+		cType:   cType,
+		baseURL: baseURL,
+		wg:      &sync.WaitGroup{},
+	}
+}
+
+func (t *trackDownload) jobType() WJobType {
+	switch t.cType {
+	case ContentTypeAudio:
+		if t.single {
+			return AudioSegmentDL
+		}
+		return AudioPartialSegmentDL
+	case ContentTypeVideo:
+		if t.single {
+			return VideoSegmentDL
+		}
+		return VideoPartialSegmentDL
+	default:
+		if t.single {
+			return TextSegmentDL
+		}
+		return TextPartialSegmentDL
+	}
+}
+
+// startPeriod is called before queuing the segments of a new period, the
+// segments of a period that doesn't continue the previous one are
+// reassembled separately.
+func (t *trackDownload) startPeriod(continuous bool) {
+	if !continuous {
+		t.newPart = true
+	}
+}
+
+// part returns the part the next segment belongs to.
+// The text tracks are extracted in one pass whatever their periods.
+func (t *trackDownload) part() *trackPart {
+	last := len(t.parts) - 1
+	if last < 0 || (t.newPart && t.parts[last].jobs > 0 && t.cType != ContentTypeText) {
+		pattern := t.filenamePattern
+		if last >= 0 {
+			pattern = strings.TrimSuffix(pattern, segmentSuffix) + "_p" + strconv.Itoa(last+1) + segmentSuffix
+		}
+		t.parts = append(t.parts, &trackPart{pattern: pattern})
+	}
+	t.newPart = false
+	return t.parts[len(t.parts)-1]
+}
+
+// queue sends the segments resolved against base to the segment workers, it
+// blocks until the workers pick them up but doesn't wait for the downloads.
+func (t *trackDownload) queue(base *url.URL, segments ...*Segment) {
+	if len(segments) == 0 {
+		return
+	}
+	if t.filenamePattern == "" {
+		// representations can share segment names (init.mp4 in a folder per representation)
+		t.filenamePattern = t.prefix + filenameCleaner.Replace(strPtrtoS(t.r.ID)) + "_" + segmentFilename(segments[0].URL) + segmentSuffix
+	}
+
+	var reused int
+	var queued, toQueue []*WJob
+	for _, segment := range segments {
+		if segment.Init {
+			initKey := segment.URL + "|" + segment.ByteRange
+			if initKey == t.lastInit && !t.newPart {
+				// continuous periods sharing the initialization segment
+				// only need it once
+				continue
+			}
+			if initKey != t.lastInit {
+				t.newPart = true
+			}
+			t.lastInit = initKey
+		}
+		part := t.part()
+		part.jobs++
+		if !segment.Init {
+			part.duration += segment.Duration
+		}
+
+		pos := len(t.jobs)
+		outFilename := part.pattern + strconv.Itoa(pos)
+		segJob := &WJob{
+			Type:         t.jobType(),
+			Pos:          pos,
+			URL:          segment.URL,
+			Mirrors:      segment.Mirrors,
+			ByteRange:    segment.ByteRange,
+			AbsolutePath: t.workspace.path(outFilename),
+			Filename:     outFilename,
+			hosts:        t.hosts,
+			signing:      t.signing,
+			client:       t.client,
+			retry:        t.retry,
+			workspace:    t.workspace,
+			segmentKey:   segmentKey(segment.URL, base),
+			payload:      t.payloadCheck(segment),
+			ctx:          t.ctx,
+			events:       t.events,
+			track:        t.info,
+			log:          t.log,
+			wg:           t.wg,
+		}
+		t.jobs = append(t.jobs, segJob)
+		queued = append(queued, segJob)
+		if t.workspace.verify(outFilename, segJob.segmentKey, isMP4Container(t.r)) {
+			reused++
+			continue
+		}
+		toQueue = append(toQueue, segJob)
+	}
+	for _, segJob := range queued {
+		segJob.Total = len(t.jobs)
+	}
+	if reused > 0 {
+		t.log.Info("segments already downloaded", "segments", reused)
+	}
+	t.workspace.registerTrack(t.filenamePattern, strPtrtoS(t.r.ID), t.cType, len(t.jobs))
+	t.events.queued(t.info, len(queued), reused)
+
+	for _, segJob := range toQueue {
+		if t.ctx.Err() != nil {
+			// the job was cancelled, the remaining segments aren't queued
+			break
+		}
+		t.wg.Add(1)
+		select {
+		case t.segments <- segJob:
+		case <-t.ctx.Done():
+			segJob.Err = t.ctx.Err()
+			t.wg.Done()
+		}
+	}
+}
+
+// payloadCheck returns how the responses to the segment requests are
+// validated.
+func (t *trackDownload) payloadCheck(segment *Segment) *payloadCheck {
+	check := &payloadCheck{container: containerOf(t.r), sizeTolerance: t.sizeTolerance}
+	// the size of the text and initialization segments isn't related to
+	// the bandwidth
+	if t.cType != ContentTypeText && !segment.Init {
+		check.bandwidth = int64(int64PtrToI(t.r.Bandwidth))
+		check.duration = segment.Duration
+	}
+	return check
+}
+
+// wait blocks until all the queued segments are downloaded and returns the
+// first download error.
+func (t *trackDownload) wait() error {
+	t.wg.Wait()
+	t.workspace.save()
+	if err := t.ctx.Err(); err != nil {
+		// the downloaded segments are kept to resume the job
+		return err
+	}
+	var first *SegmentError
+	failed := 0
+	for _, segJob := range t.jobs {
+		if segJob.Err == nil {
+			continue
+		}
+		failed++
+		if first == nil {
+			first = &SegmentError{
+				ContentType:      t.cType,
+				RepresentationID: strPtrtoS(t.r.ID),
+				Index:            segJob.Pos,
+				URL:              segJob.URL,
+				Attempts:         segJob.attempts,
+				Err:              segJob.Err,
+			}
+		}
+	}
+	if failed > 1 {
+		t.log.Error("segments failed to download", "segments", failed)
+	}
+	if first != nil {
+		return first
+	}
+	return nil
+}
+
+// assemble waits for the downloads and reassembles the segments into a
+// single file.
+func (t *trackDownload) assemble() (*OutputTrack, error) {
+	if err := t.wait(); err != nil {
+		return nil, err
+	}
+	if len(t.jobs) == 0 {
+		return nil, fmt.Errorf("no %s segments downloaded for representation %s - %w", t.cType, strPtrtoS(t.r.ID), ErrMissingSegments)
+	}
+
+	outFilename := strings.TrimSuffix(t.filenamePattern, segmentSuffix)
+	// the track to reassemble
+	tempPathPattern := t.workspace.path(outFilename)
+	ext := guessedExtension(t.r)
+	if ext == "" {
+		ext = path.Ext(outFilename)
+	}
+	outPath := strings.TrimSuffix(tempPathPattern, path.Ext(outFilename)) + ext
+
+	// text tracks packaged in mp4 need their text extracted, sidecar files
+	// (vtt, ttml) are used as is.
+	extractText := t.cType == ContentTypeText && isMP4Text(t.r)
+	var err error
+	if len(t.parts) > 1 {
+		// the parts are joined in a container supporting all the codecs
+		outPath = strings.TrimSuffix(outPath, ext) + ".mkv"
+		t.log.Info("reassembling the segments", "path", outPath, "parts", len(t.parts))
+		t.events.reassembly(t.info, outPath, false, nil)
+		err = t.assembleParts(outPath, ext)
+	} else {
+		t.log.Info("reassembling the segments", "path", outPath)
+		t.events.reassembly(t.info, outPath, false, nil)
+		err = reassembleFile(t.ctx, tempPathPattern, segmentSuffix, outPath, len(t.jobs), extractText)
+	}
+	t.events.reassembly(t.info, outPath, true, err)
+	if err != nil {
+		return nil, fmt.Errorf("error reassembling file: %s - %w", outPath, err)
+	}
+
+	return &OutputTrack{
+		RepresentationID: strPtrtoS(t.r.ID),
+		BaseURL:          t.baseURL.String(),
+		Language:         strPtrtoS(t.r.AdaptationSet.Lang),
+		AbsolutePath:     outPath,
+		Codec:            repCodecs(t.r),
+		SampleRate:       int64PtrToI(t.r.AudioSamplingRate),
+		MediaType:        t.cType,
+	}, nil
+}
+
+// assembleParts reassembles the parts of the track separately and joins them
+// with ffmpeg, which shifts the timestamps of each part to start where the
+// previous one ends. Each part keeps its own initialization segment.
+func (t *trackDownload) assembleParts(outPath, ext string) error {
+	files := make([]concatFile, 0, len(t.parts))
+	defer func() {
+		for _, file := range files {
+			os.Remove(file.path)
+		}
+	}()
+	for i, part := range t.parts {
+		partPath := strings.TrimSuffix(outPath, filepath.Ext(outPath)) + "_part" + strconv.Itoa(i) + ext
+		tempPathPattern := t.workspace.path(strings.TrimSuffix(part.pattern, segmentSuffix))
+		if err := reassembleFile(t.ctx, tempPathPattern, segmentSuffix, partPath, part.jobs, false); err != nil {
+			return fmt.Errorf("failed to reassemble part %d - %w", i, err)
+		}
+		files = append(files, concatFile{path: partPath, duration: part.duration})
+	}
+	return concatFiles(t.ctx, files, outPath)
+}
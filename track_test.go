@@ -0,0 +1,160 @@
+package mpdgrabber
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattetti/go-dash/mpd"
+)
+
+// fakeFFmpeg installs an ffmpeg script on the PATH writing the concatenated
+// content of the files listed in the concat script to its output, followed
+// by their durations.
+func fakeFFmpeg(t *testing.T) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake ffmpeg is a shell script")
+	}
+	dir := t.TempDir()
+	script := `#!/bin/sh
+for a; do last="$a"; done
+list="$7"
+sed -n "s/^file '\(.*\)'$/\1/p" "$list" | while read -r f; do cat "$f"; done > "$last"
+grep "^duration" "$list" >> "$last"
+`
+	if err := os.WriteFile(filepath.Join(dir, "ffmpeg"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestTrackDownloadStitchesPeriods(t *testing.T) {
+	fakeFFmpeg(t)
+	ws, err := openWorkspace(t.TempDir(), "stitch", "https://example.com/multi.mpd", discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheme, continued := periodContinuityScheme, "ad"
+	// the content periods are split by an ad period, the last one continues
+	// the ad period without a new initialization segment
+	selections := []*trackSelection{
+		{PeriodKey: "content", AdaptationSet: &mpd.AdaptationSet{}},
+		{PeriodKey: "ad", AdaptationSet: &mpd.AdaptationSet{}},
+		{PeriodKey: "content2", AdaptationSet: &mpd.AdaptationSet{}},
+	}
+	selections[2].AdaptationSet.SupplementalProperty = []mpd.DescriptorType{{SchemeIDURI: &scheme, Value: &continued}}
+	periods := [][]*Segment{
+		{
+			{URL: "https://example.com/content/init.mp4", Init: true},
+			{URL: "https://example.com/content/1.m4s", Duration: 2 * time.Second},
+			{URL: "https://example.com/content/2.m4s", Duration: 2 * time.Second},
+		},
+		{
+			{URL: "https://example.com/ad/init.mp4", Init: true},
+			{URL: "https://example.com/ad/1.m4s", Duration: 1500 * time.Millisecond},
+		},
+		{
+			{URL: "https://example.com/ad/init.mp4", Init: true},
+			{URL: "https://example.com/ad/2.m4s", Duration: 1500 * time.Millisecond},
+		},
+	}
+
+	id, mimeType := "video", "video/mp4"
+	r := &mpd.Representation{ID: &id, AdaptationSet: &mpd.AdaptationSet{}}
+	r.MimeType = &mimeType
+	segments := make(chan *WJob, 10)
+	td := newTrackDownload(r, ContentTypeVideo, &url.URL{Scheme: "https", Host: "example.com"})
+	td.workspace = ws
+	td.segments = segments
+	td.ctx = context.Background()
+	td.log = discardLogger
+	for i, sel := range selections {
+		if i > 0 {
+			td.startPeriod(sel.continues(selections[i-1]))
+		}
+		td.queue(td.baseURL, periods[i]...)
+	}
+	close(segments)
+	// the segment files hold the path of their url
+	for job := range segments {
+		u, _ := url.Parse(job.URL)
+		if err := os.WriteFile(job.AbsolutePath, []byte(u.Path+"|"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		job.wg.Done()
+	}
+
+	if len(td.parts) != 2 {
+		t.Fatalf("got %d parts, want 2", len(td.parts))
+	}
+	track, err := td.assemble()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Ext(track.AbsolutePath) != ".mkv" {
+		t.Errorf("the stitched track should be a matroska file, got %s", track.AbsolutePath)
+	}
+	data, err := os.ReadFile(track.AbsolutePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "/content/init.mp4|/content/1.m4s|/content/2.m4s|" +
+		"/ad/init.mp4|/ad/1.m4s|/ad/2.m4s|" +
+		"duration 4.000000\nduration 3.000000\n"
+	if string(data) != want {
+		t.Errorf("stitched track =\n%s\nwant\n%s", data, want)
+	}
+	// the intermediate files are removed
+	matches, _ := filepath.Glob(filepath.Join(ws.dir, "*_part*"))
+	if len(matches) > 0 {
+		t.Errorf("the parts weren't removed: %v", matches)
+	}
+}
+
+func TestTrackDownloadSinglePartWithoutFFmpeg(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	ws, err := openWorkspace(t.TempDir(), "single", "https://example.com/single.mpd", discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, mimeType := "audio", "audio/mp4"
+	r := &mpd.Representation{ID: &id, AdaptationSet: &mpd.AdaptationSet{}}
+	r.MimeType = &mimeType
+	segments := make(chan *WJob, 10)
+	td := newTrackDownload(r, ContentTypeAudio, &url.URL{Scheme: "https", Host: "example.com"})
+	td.workspace = ws
+	td.segments = segments
+	td.ctx = context.Background()
+	td.log = discardLogger
+	// both periods share the initialization segment and are continuous
+	td.queue(td.baseURL, &Segment{URL: "https://example.com/init.mp4", Init: true}, &Segment{URL: "https://example.com/1.m4s"})
+	td.startPeriod(true)
+	td.queue(td.baseURL, &Segment{URL: "https://example.com/init.mp4", Init: true}, &Segment{URL: "https://example.com/2.m4s"})
+	close(segments)
+	for job := range segments {
+		u, _ := url.Parse(job.URL)
+		os.WriteFile(job.AbsolutePath, []byte(u.Path+"|"), 0644)
+		job.wg.Done()
+	}
+
+	track, err := td.assemble()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(track.AbsolutePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "/init.mp4|/1.m4s|/2.m4s|"; got != want {
+		t.Errorf("reassembled track = %s, want %s", got, want)
+	}
+	if strings.HasSuffix(track.AbsolutePath, ".mkv") {
+		t.Errorf("a single part track shouldn't go through ffmpeg, got %s", track.AbsolutePath)
+	}
+}
@@ -0,0 +1,129 @@
+package mpdgrabber
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// QueryPolicy controls how the query string of the manifest url (signed
+// CDN tokens for instance) is propagated to the segment, initialization and
+// index urls. The copy and merge policies only apply to the urls on the host
+// of the manifest so the tokens don't leak to third parties.
+type QueryPolicy int
+
+const (
+	// QueryPolicyNone leaves the urls untouched.
+	QueryPolicyNone QueryPolicy = iota
+	// QueryPolicyCopy replaces the query of the urls by the manifest query.
+	QueryPolicyCopy
+	// QueryPolicyMerge adds the manifest query parameters missing from the
+	// urls, the parameters of the urls are kept.
+	QueryPolicyMerge
+	// QueryPolicyRewrite calls WJob.RewriteURL for each url.
+	QueryPolicyRewrite
+)
+
+func (p QueryPolicy) String() string {
+	switch p {
+	case QueryPolicyNone:
+		return "none"
+	case QueryPolicyCopy:
+		return "copy"
+	case QueryPolicyMerge:
+		return "merge"
+	case QueryPolicyRewrite:
+		return "rewrite"
+	default:
+		return UnknownString
+	}
+}
+
+// ParseQueryPolicy parses the name of a query policy (none, copy, merge).
+func ParseQueryPolicy(name string) (QueryPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "none":
+		return QueryPolicyNone, nil
+	case "copy":
+		return QueryPolicyCopy, nil
+	case "merge":
+		return QueryPolicyMerge, nil
+	case "rewrite":
+		return QueryPolicyRewrite, nil
+	}
+	return QueryPolicyNone, fmt.Errorf("unknown query policy %q", name)
+}
+
+// urlRewriter applies the query policy of a job.
+type urlRewriter struct {
+	policy      QueryPolicy
+	manifestURL *url.URL
+	rewrite     func(resourceURL, manifestURL *url.URL) *url.URL
+}
+
+// newURLRewriter returns nil when the urls don't need to be rewritten.
+func newURLRewriter(job *WJob, manifestURL *url.URL) *urlRewriter {
+	switch job.QueryPolicy {
+	case QueryPolicyNone:
+		return nil
+	case QueryPolicyRewrite:
+		if job.RewriteURL == nil {
+			job.logger().Warn("rewrite query policy without RewriteURL function, the urls won't be rewritten")
+			return nil
+		}
+	}
+	return &urlRewriter{
+		policy:      job.QueryPolicy,
+		manifestURL: manifestURL,
+		rewrite:     job.RewriteURL,
+	}
+}
+
+// apply returns the rewritten url, the url is returned as is if it can't be
+// parsed.
+func (r *urlRewriter) apply(rawURL string) string {
+	if r == nil {
+		return rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+
+	if r.policy != QueryPolicyRewrite && !strings.EqualFold(u.Host, r.manifestURL.Host) {
+		return rawURL
+	}
+
+	switch r.policy {
+	case QueryPolicyCopy:
+		u.RawQuery = r.manifestURL.RawQuery
+	case QueryPolicyMerge:
+		if u.RawQuery == "" {
+			u.RawQuery = r.manifestURL.RawQuery
+			break
+		}
+		query := u.Query()
+		for key, values := range r.manifestURL.Query() {
+			if _, ok := query[key]; !ok {
+				query[key] = values
+			}
+		}
+		u.RawQuery = query.Encode()
+	case QueryPolicyRewrite:
+		manifestURL := *r.manifestURL
+		if rewritten := r.rewrite(u, &manifestURL); rewritten != nil {
+			u = rewritten
+		}
+	}
+	return u.String()
+}
+
+// applySegments rewrites the urls of the segments.
+func (r *urlRewriter) applySegments(segments []*Segment) {
+	if r == nil {
+		return
+	}
+	for _, segment := range segments {
+		segment.URL = r.apply(segment.URL)
+	}
+}
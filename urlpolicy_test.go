@@ -0,0 +1,53 @@
+package mpdgrabber
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestURLRewriterApply(t *testing.T) {
+	manifestURL, _ := url.Parse("https://cdn.example.com/live/manifest.mpd?token=abc&exp=100")
+	rewrite := func(resourceURL, manifestURL *url.URL) *url.URL {
+		resourceURL.Host = "signed.example.com"
+		return resourceURL
+	}
+
+	tests := []struct {
+		name   string
+		policy QueryPolicy
+		url    string
+		want   string
+	}{
+		{"copy inherits the manifest query", QueryPolicyCopy,
+			"https://cdn.example.com/live/seg_1.m4s", "https://cdn.example.com/live/seg_1.m4s?token=abc&exp=100"},
+		{"copy replaces the segment query", QueryPolicyCopy,
+			"https://cdn.example.com/live/seg_1.m4s?token=old", "https://cdn.example.com/live/seg_1.m4s?token=abc&exp=100"},
+		{"merge inherits the manifest query", QueryPolicyMerge,
+			"https://cdn.example.com/live/seg_1.m4s", "https://cdn.example.com/live/seg_1.m4s?token=abc&exp=100"},
+		{"merge keeps the segment parameters", QueryPolicyMerge,
+			"https://cdn.example.com/live/seg_1.m4s?token=seg&v=2", "https://cdn.example.com/live/seg_1.m4s?exp=100&token=seg&v=2"},
+		{"host matching ignores the case", QueryPolicyCopy,
+			"https://CDN.example.com/live/seg_1.m4s", "https://CDN.example.com/live/seg_1.m4s?token=abc&exp=100"},
+		{"copy skips the other hosts", QueryPolicyCopy,
+			"https://other.example.com/live/seg_1.m4s", "https://other.example.com/live/seg_1.m4s"},
+		{"merge skips the other hosts", QueryPolicyMerge,
+			"https://other.example.com/live/seg_1.m4s?v=2", "https://other.example.com/live/seg_1.m4s?v=2"},
+		{"other port is another host", QueryPolicyMerge,
+			"https://cdn.example.com:8443/live/seg_1.m4s", "https://cdn.example.com:8443/live/seg_1.m4s"},
+		{"rewrite applies to every host", QueryPolicyRewrite,
+			"https://other.example.com/live/seg_1.m4s", "https://signed.example.com/live/seg_1.m4s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job := &WJob{QueryPolicy: tt.policy, RewriteURL: rewrite}
+			r := newURLRewriter(job, manifestURL)
+			if got := r.apply(tt.url); got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+
+	if r := newURLRewriter(&WJob{}, manifestURL); r.apply("https://cdn.example.com/seg_1.m4s") != "https://cdn.example.com/seg_1.m4s" {
+		t.Error("expected the urls to be left untouched without query policy")
+	}
+}
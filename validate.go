@@ -0,0 +1,244 @@
+package mpdgrabber
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mattetti/go-dash/mpd"
+)
+
+// isMP4Container reports if the segments of the representation are ISO-BMFF
+// (mp4) fragments.
+func isMP4Container(r *mpd.Representation) bool {
+	return containerOf(r) == containerMP4
+}
+
+// validateMP4Boxes checks that the file is a sequence of complete top-level
+// ISO-BMFF boxes, a truncated file ends in the middle of a box.
+func validateMP4Boxes(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	fileSize := info.Size()
+
+	var offset int64
+	header := make([]byte, 16)
+	for offset < fileSize {
+		if fileSize-offset < 8 {
+			return fmt.Errorf("truncated box header at offset %d", offset)
+		}
+		if _, err := f.ReadAt(header[:8], offset); err != nil {
+			return err
+		}
+		if !isBoxType(header[4:8]) {
+			return fmt.Errorf("invalid box type %q at offset %d", header[4:8], offset)
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		headerSize := int64(8)
+		switch size {
+		case 0:
+			// the box extends to the end of the file
+			return nil
+		case 1:
+			// 64 bit size
+			if _, err := f.ReadAt(header[8:16], offset+8); err != nil {
+				if err == io.EOF {
+					return fmt.Errorf("truncated box header at offset %d", offset)
+				}
+				return err
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerSize = 16
+		}
+		if size < headerSize {
+			return fmt.Errorf("invalid %q box size %d at offset %d", header[4:8], size, offset)
+		}
+		if offset+size > fileSize {
+			return fmt.Errorf("truncated %q box at offset %d (%d bytes missing)", header[4:8], offset, offset+size-fileSize)
+		}
+		offset += size
+	}
+	return nil
+}
+
+// isBoxType reports if the 4 bytes can be the type of a top-level box
+// (printable characters).
+func isBoxType(typ []byte) bool {
+	for _, c := range typ {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// defaultSegmentSizeTolerance is the Options.SegmentSizeTolerance by default.
+const defaultSegmentSizeTolerance = 20.0
+
+// ErrInvalidPayload is returned when a server answers a segment request with
+// something else than the segment (an error page for instance).
+var ErrInvalidPayload = errors.New("invalid segment payload")
+
+// container formats of the segments
+const (
+	containerUnknown = ""
+	containerMP4     = "mp4"
+	containerWebM    = "webm"
+	containerTS      = "mpeg-ts"
+	containerVTT     = "webvtt"
+	containerTTML    = "ttml"
+)
+
+// containerOf returns the container format of the segments of the
+// representation, from its mime type.
+func containerOf(r *mpd.Representation) string {
+	if r == nil {
+		return containerUnknown
+	}
+	mimeType := strPtrtoEmpty(r.MimeType)
+	if mimeType == "" && r.AdaptationSet != nil {
+		mimeType = strPtrtoEmpty(r.AdaptationSet.MimeType)
+	}
+	mimeType = strings.ToLower(mimeType)
+	switch {
+	case strings.Contains(mimeType, "mp4"):
+		return containerMP4
+	case strings.Contains(mimeType, "webm"):
+		return containerWebM
+	case strings.Contains(mimeType, "mp2t"):
+		return containerTS
+	case strings.Contains(mimeType, "vtt"):
+		return containerVTT
+	case strings.Contains(mimeType, "ttml"):
+		return containerTTML
+	}
+	return containerUnknown
+}
+
+// payloadCheck describes the segment expected in a response.
+type payloadCheck struct {
+	container string
+	// bandwidth (bits per second) and duration give the expected size of
+	// media segments
+	bandwidth int64
+	duration  time.Duration
+	// sizeTolerance is how far the size can be from the expected one, the
+	// size isn't checked if it's not positive
+	sizeTolerance float64
+}
+
+// mp4TopLevelBoxes are the boxes a mp4 segment can start with.
+var mp4TopLevelBoxes = map[string]bool{
+	"ftyp": true, "styp": true, "sidx": true, "ssix": true, "moof": true,
+	"moov": true, "mdat": true, "emsg": true, "prft": true, "free": true,
+	"skip": true, "uuid": true, "meta": true, "pdin": true, "mfra": true,
+}
+
+// EBML ids a webm segment can start with
+var webmElementIDs = [][]byte{
+	{0x1A, 0x45, 0xDF, 0xA3}, // EBML header
+	{0x18, 0x53, 0x80, 0x67}, // Segment
+	{0x1F, 0x43, 0xB6, 0x75}, // Cluster
+	{0x1C, 0x53, 0xBB, 0x6B}, // Cues
+}
+
+// validate checks the Content-Type, the first bytes and the size of a
+// response, head holds the first bytes of the body.
+func (c *payloadCheck) validate(contentType string, head []byte, size int64) error {
+	if c == nil {
+		return nil
+	}
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	switch {
+	case strings.Contains(mediaType, "html"), strings.Contains(mediaType, "json"):
+		return fmt.Errorf("unexpected Content-Type %s - %w", mediaType, ErrInvalidPayload)
+	case strings.HasSuffix(mediaType, "/xml") && c.container != containerTTML:
+		return fmt.Errorf("unexpected Content-Type %s - %w", mediaType, ErrInvalidPayload)
+	}
+
+	if size == 0 {
+		return fmt.Errorf("empty body - %w", ErrInvalidPayload)
+	}
+	if err := c.checkSignature(head); err != nil {
+		return err
+	}
+
+	if c.sizeTolerance > 0 && c.bandwidth > 0 && c.duration > 0 {
+		expected := float64(c.bandwidth) / 8 * c.duration.Seconds()
+		if float64(size) > expected*c.sizeTolerance || float64(size)*c.sizeTolerance < expected {
+			return fmt.Errorf("%d bytes received, about %.0f bytes expected - %w", size, expected, ErrInvalidPayload)
+		}
+	}
+	return nil
+}
+
+// checkSignature checks the first bytes of the body against the container.
+func (c *payloadCheck) checkSignature(head []byte) error {
+	text := bytes.TrimLeft(bytes.TrimPrefix(head, []byte("\ufeff")), " \t\r\n")
+	switch c.container {
+	case containerMP4:
+		if len(head) >= 8 && mp4TopLevelBoxes[string(head[4:8])] {
+			return nil
+		}
+	case containerWebM:
+		for _, id := range webmElementIDs {
+			if bytes.HasPrefix(head, id) {
+				return nil
+			}
+		}
+	case containerTS:
+		// sync byte at the start of each 188 bytes packet
+		if len(head) > 0 && head[0] == 0x47 && (len(head) <= 188 || head[188] == 0x47) {
+			return nil
+		}
+	case containerVTT:
+		if bytes.HasPrefix(text, []byte("WEBVTT")) {
+			return nil
+		}
+	case containerTTML:
+		if bytes.HasPrefix(text, []byte("<")) && !looksLikeHTML(text) {
+			return nil
+		}
+	default:
+		if !looksLikeHTML(text) && !bytes.HasPrefix(text, []byte("{")) {
+			return nil
+		}
+	}
+	return fmt.Errorf("the body doesn't look like a %s segment (starts with %q) - %w", c.containerName(), previewBytes(head), ErrInvalidPayload)
+}
+
+func (c *payloadCheck) containerName() string {
+	if c.container == containerUnknown {
+		return "media"
+	}
+	return c.container
+}
+
+func looksLikeHTML(text []byte) bool {
+	prefix := strings.ToLower(string(text[:minInt(len(text), 64)]))
+	return strings.HasPrefix(prefix, "<!doctype html") || strings.HasPrefix(prefix, "<html")
+}
+
+// previewBytes returns the first bytes of a body for error messages.
+func previewBytes(head []byte) []byte {
+	return head[:minInt(len(head), 16)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,174 @@
+package mpdgrabber
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mattetti/go-dash/mpd"
+)
+
+func TestPayloadCheckValidate(t *testing.T) {
+	mp4Segment := []byte("\x00\x00\x00\x18stypmsdh\x00\x00\x00\x00msdhmsix")
+	tsPacket := make([]byte, 376)
+	tsPacket[0], tsPacket[188] = 0x47, 0x47
+	badTSPacket := make([]byte, 376)
+	badTSPacket[0] = 0x47
+	// 1 Mbps for 2 seconds, about 250 000 bytes
+	sized := &payloadCheck{container: containerMP4, bandwidth: 1000000, duration: 2 * time.Second, sizeTolerance: 20}
+	tests := []struct {
+		name        string
+		check       *payloadCheck
+		contentType string
+		body        []byte
+		size        int64
+		valid       bool
+	}{
+		{"no check", nil, "text/html", []byte("<html>"), 6, true},
+		{"html error page with a 200 status", &payloadCheck{container: containerMP4}, "text/html; charset=utf-8", []byte("<html>"), 6, false},
+		{"json body", &payloadCheck{container: containerMP4}, "application/json", []byte(`{"error": "expired"}`), 20, false},
+		{"xml body of a mp4 segment", &payloadCheck{container: containerMP4}, "application/xml", []byte("<Error/>"), 8, false},
+		{"xml body of a ttml segment", &payloadCheck{container: containerTTML}, "application/xml", []byte(`<?xml version="1.0"?><tt/>`), 26, true},
+		{"empty body", &payloadCheck{container: containerMP4}, "video/mp4", nil, 0, false},
+		{"mp4", &payloadCheck{container: containerMP4}, "video/mp4", mp4Segment, 24, true},
+		{"html body served as mp4", &payloadCheck{container: containerMP4}, "video/mp4", []byte("<!DOCTYPE html><html>"), 21, false},
+		{"webm", &payloadCheck{container: containerWebM}, "video/webm", []byte("\x1A\x45\xDF\xA3\x9f"), 5, true},
+		{"webm cluster", &payloadCheck{container: containerWebM}, "video/webm", []byte("\x1F\x43\xB6\x75\x01"), 5, true},
+		{"invalid webm", &payloadCheck{container: containerWebM}, "video/webm", mp4Segment, 24, false},
+		{"ts", &payloadCheck{container: containerTS}, "video/mp2t", tsPacket, 376, true},
+		{"ts without the second sync byte", &payloadCheck{container: containerTS}, "video/mp2t", badTSPacket, 376, false},
+		{"vtt", &payloadCheck{container: containerVTT}, "text/vtt", []byte("\ufeff\nWEBVTT\n\n"), 11, true},
+		{"invalid vtt", &payloadCheck{container: containerVTT}, "text/vtt", []byte("<html>"), 6, false},
+		{"ttml", &payloadCheck{container: containerTTML}, "application/ttml+xml", []byte(`<tt xmlns="http://www.w3.org/ns/ttml"/>`), 38, true},
+		{"html served as ttml", &payloadCheck{container: containerTTML}, "application/ttml+xml", []byte("<html><body>"), 12, false},
+		{"unknown container", &payloadCheck{}, "application/octet-stream", []byte("data"), 4, true},
+		{"json of an unknown container", &payloadCheck{}, "application/octet-stream", []byte(`{"error": 1}`), 12, false},
+		{"expected size", sized, "video/mp4", mp4Segment, 250000, true},
+		{"at the upper bound", sized, "video/mp4", mp4Segment, 250000 * 20, true},
+		{"too large", sized, "video/mp4", mp4Segment, 250000*20 + 1, false},
+		{"at the lower bound", sized, "video/mp4", mp4Segment, 250000 / 20, true},
+		{"too small", sized, "video/mp4", mp4Segment, 250000/20 - 1, false},
+		{"size not checked", &payloadCheck{container: containerMP4, bandwidth: 1000000, duration: 2 * time.Second}, "video/mp4", mp4Segment, 24, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.check.validate(tt.contentType, tt.body, tt.size)
+			if tt.valid && err != nil {
+				t.Errorf("validate() = %v, want nil", err)
+			}
+			if !tt.valid && !errors.Is(err, ErrInvalidPayload) {
+				t.Errorf("validate() = %v, want %v", err, ErrInvalidPayload)
+			}
+		})
+	}
+}
+
+func TestContainerOf(t *testing.T) {
+	tests := []struct {
+		mimeType string
+		want     string
+	}{
+		{"video/mp4", containerMP4},
+		{"audio/MP4", containerMP4},
+		{"application/mp4", containerMP4},
+		{"video/webm", containerWebM},
+		{"video/mp2t", containerTS},
+		{"text/vtt", containerVTT},
+		{"application/ttml+xml", containerTTML},
+		{"", containerUnknown},
+	}
+	for _, tt := range tests {
+		r := representationWithMimeType(tt.mimeType)
+		if got := containerOf(r); got != tt.want {
+			t.Errorf("containerOf(%q) = %q, want %q", tt.mimeType, got, tt.want)
+		}
+		if got := isMP4Container(r); got != (tt.want == containerMP4) {
+			t.Errorf("isMP4Container(%q) = %t", tt.mimeType, got)
+		}
+	}
+	if containerOf(nil) != containerUnknown || isMP4Container(nil) {
+		t.Error("a nil representation has no container")
+	}
+}
+
+// representationWithMimeType returns a representation inheriting its mime
+// type from its adaptation set.
+func representationWithMimeType(mimeType string) *mpd.Representation {
+	as := &mpd.AdaptationSet{}
+	if mimeType != "" {
+		as.MimeType = &mimeType
+	}
+	return &mpd.Representation{AdaptationSet: as}
+}
+
+func TestValidateMP4Boxes(t *testing.T) {
+	free := "\x00\x00\x00\x08free"
+	tests := []struct {
+		name  string
+		data  string
+		valid bool
+	}{
+		{"complete boxes", "\x00\x00\x00\x0cstyp\x00\x00\x00\x00" + free, true},
+		{"truncated header", free + "\x00\x00\x00", false},
+		{"truncated box", "\x00\x00\x00\x10mdat\x00\x00\x00\x00", false},
+		{"box to the end of the file", free + "\x00\x00\x00\x00mdat" + "media data", true},
+		{"64 bit largesize", "\x00\x00\x00\x01mdat\x00\x00\x00\x00\x00\x00\x00\x14data" + free, true},
+		{"truncated 64 bit largesize", "\x00\x00\x00\x01mdat\x00\x00\x00\x00\x00\x00\x01\x00data", false},
+		{"truncated largesize header", "\x00\x00\x00\x01mdat\x00\x00", false},
+		{"size smaller than the header", "\x00\x00\x00\x04free", false},
+		{"largesize smaller than the header", "\x00\x00\x00\x01mdat\x00\x00\x00\x00\x00\x00\x00\x08", false},
+		{"non printable type", "\x00\x00\x00\x08\x00\x01\x02\x03", false},
+	}
+	dir := t.TempDir()
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, strconv.Itoa(i))
+			if err := os.WriteFile(path, []byte(tt.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			err := validateMP4Boxes(path)
+			if tt.valid && err != nil {
+				t.Errorf("validateMP4Boxes() = %v, want nil", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("validateMP4Boxes() = nil, want an error")
+			}
+		})
+	}
+}
+
+func TestTruncatedSegmentNotRenamed(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// without Content-Length, the connection closed in the middle of
+		// the mdat box
+		w.Write([]byte("\x00\x00\x00\x08styp"))
+		w.(http.Flusher).Flush()
+		w.Write([]byte("\x00\x00\x01\x00mdat partial"))
+	}))
+	defer srv.Close()
+
+	ws, err := openWorkspace(t.TempDir(), "truncated", srv.URL+"/manifest.mpd", discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.close()
+	path := ws.path("video_seg_1")
+	_, err = downloadFileRequest(context.Background(), srv.Client(), srv.URL+"/seg_1.m4s", "", nil, path, &payloadCheck{container: containerMP4})
+	if !errors.Is(err, errIncompleteBody) {
+		t.Fatalf("downloadFileRequest() = %v, want %v", err, errIncompleteBody)
+	}
+	for _, p := range []string{path, path + partSuffix} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s was left in the workspace", filepath.Base(p))
+		}
+	}
+	if ws.verify("video_seg_1", "seg_1.m4s", true) {
+		t.Error("the truncated segment is reused")
+	}
+}
@@ -1,9 +1,10 @@
 package mpdgrabber
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
@@ -11,23 +12,32 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mattetti/go-dash/mpd"
 )
 
+// The package variables configure the workers started by LaunchWorkers, use
+// a Grabber to run downloads with different settings.
 var (
-	TotalWorkers         = 6
-	TmpFolder, _         = ioutil.TempDir("", "mpdgrabber")
+	TotalWorkers = defaultWorkers
+	// TmpFolder holds the job workspaces, the segments of an interrupted job
+	// are found there when it runs again.
+	TmpFolder            = filepath.Join(os.TempDir(), "mpdgrabber")
 	filenameCleaner      = strings.NewReplacer("/", "-", "!", "", "?", "", ",", "")
 	AudioDownloadEnabled = true
 	VideoDownloadEnabled = true
 	TextDownloadEnabled  = true
 	// inclusive filter, all languages are downloaded by default
 	LangFilter = []string{}
+	// SplitPeriods writes each period to its own output file instead of
+	// stitching the periods together.
+	SplitPeriods = false
 
-	DlChan  = make(chan *WJob)
-	segChan = make(chan *WJob)
+	// DlChan receives the manifest jobs of the workers started by
+	// LaunchWorkers.
+	DlChan chan *WJob
 )
 
 type WJobType int
@@ -67,20 +77,30 @@ func (w WJobType) String() string {
 	}
 }
 
-// LaunchWorkers starts download workers
+// LaunchWorkers starts download workers configured with the package
+// variables, wg is done once Close is called and the workers are out.
+// Receiving from stop cancels the running downloads.
 func LaunchWorkers(wg *sync.WaitGroup, stop <-chan bool) {
-	DlChan = make(chan *WJob)
-	segChan = make(chan *WJob)
+	// the package options don't set any http option, it can't fail
+	g, _ := NewGrabber(packageOptions())
+	defaultGrabber = g
+	DlChan = g.jobs
 
-	// the main worker downloads one full manifest at a time but
-	// segments are downloaded concurrently
-	mainW := &Worker{id: 0, wg: wg, main: true}
-	go mainW.Work()
-
-	for i := 1; i < TotalWorkers+1; i++ {
-		w := &Worker{id: i, wg: wg, client: &http.Client{}}
-		go w.Work()
+	ctx, cancel := context.WithCancel(context.Background())
+	defaultCtx = ctx
+	if stop != nil {
+		go func() {
+			<-stop
+			cancel()
+		}()
 	}
+
+	wg.Add(1)
+	go func() {
+		g.workers.Wait()
+		cancel()
+		wg.Done()
+	}()
 }
 
 type WJob struct {
@@ -89,442 +109,602 @@ type WJob struct {
 	SubsOnly      bool
 	AudioOnly     bool
 	URL           string
-	AbsolutePath  string
-	DestPath      string
-	Filename      string
-	Pos           int
-	Total         int
-	Lang          string
+	// Mirrors are alternative urls tried in order when URL fails
+	Mirrors []string
+	// ByteRange is the optional "first-last" byte range to request
+	ByteRange    string
+	AbsolutePath string
+	DestPath     string
+	Filename     string
+	Pos          int
+	Total        int
+	Lang         string
+	// Live configures the recording of dynamic manifests
+	Live *LiveOptions
+	// SkipAdPeriods drops the periods classified as ads, the setting of the
+	// grabber is used if nil.
+	SkipAdPeriods *bool
+	// Report gets populated with what the manifest job downloaded
+	Report *DownloadReport
+	// QueryPolicy propagates the query of the manifest url to the segment
+	// urls on the same host, RewriteURL is called for each url with
+	// QueryPolicyRewrite.
+	QueryPolicy QueryPolicy
+	RewriteURL  func(resourceURL, manifestURL *url.URL) *url.URL
+	// Signer is called when a segment is rejected with a 401 or 403 status,
+	// without signer the manifest is fetched again for fresh urls.
+	Signer URLSigner
+	// WorkspaceID names the folder of the job in TmpFolder, the manifest url
+	// and the track settings are used if empty. Running a job with the same
+	// workspace resumes it, a workspace is used by one job at a time.
+	WorkspaceID string
+	// Retry configures how failed segments are retried, DefaultRetryOptions
+	// is used if nil.
+	Retry *RetryOptions
+	// Client is used for all the requests of the job (see NewHTTPClient), a
+	// client keeping the cookies is used if nil.
+	Client *http.Client
+	// OnEvent is called with the progress of the job (see Event), from the
+	// worker goroutines but never concurrently. It shouldn't block.
+	OnEvent func(Event)
 	// Err gets populated if something goes wrong while processing the job
-	Err error
+	Err     error
+	hosts   *hostHealth
+	urls    *urlRewriter
+	signing *urlSigning
+	client  *http.Client
+	retry   *RetryOptions
+	skipAds bool
+	// workspace holds the files of the job
+	workspace *workspace
+	// segmentKey identifies the segment in the workspace across runs
+	segmentKey string
+	// payload describes the expected segment
+	payload *payloadCheck
+	// attempts is the number of times the segment was tried
+	attempts int
+	grabber  *Grabber
+	// ctx cancels the job, the workspace is kept to resume it
+	ctx context.Context
+	// live is set while a live stream is recorded
+	live int32
+	// events reports the progress of the job, track is the track of a
+	// segment job
+	events *jobEvents
+	track  TrackInfo
+	// log carries the job, track and segment attributes
+	log *slog.Logger
 	wg  *sync.WaitGroup
 }
 
+// Recording reports if the job is recording a live stream, LiveOptions.Stop
+// ends the recording.
+func (j *WJob) Recording() bool {
+	return atomic.LoadInt32(&j.live) == 1
+}
+
+// logger returns the logger of the job, the package one if the job isn't
+// set up.
+func (j *WJob) logger() *slog.Logger {
+	if j.log != nil {
+		return j.log
+	}
+	return packageLogger()
+}
+
 type Worker struct {
-	id     int
-	wg     *sync.WaitGroup
-	main   bool
-	client *http.Client
+	id   int
+	g    *Grabber
+	main bool
 }
 
 func (w *Worker) Work() {
-	if Debug {
-		Logger.Printf("worker %d is ready for action\n", w.id)
-	}
+	log := w.g.logger()
+	log.Debug("worker ready", "worker", w.id)
+	defer w.g.workers.Done()
 	if w.main {
-		w.wg.Add(1)
-		for msg := range DlChan {
+		for msg := range w.g.jobs {
 			w.dispatch(msg)
 		}
-		close(segChan)
-		w.wg.Done()
+		close(w.g.segments)
 	} else {
-		for msg := range segChan {
+		for msg := range w.g.segments {
 			w.dispatch(msg)
 		}
 	}
 
-	if Debug {
-		fmt.Printf("-> Worker %d is out\n", w.id)
-	}
+	log.Debug("worker out", "worker", w.id)
 }
 
 func (w *Worker) dispatch(job *WJob) {
 	switch job.Type {
 	case ManifestDL:
 		w.downloadManifest(job)
-	case VideoSegmentDL, VideoPartialSegmentDL, AudioSegmentDL, AudioPartialSegmentDL:
-		job.wg.Add(1)
-		if Debug {
-			fmt.Printf("-> [W%d] start downloading %s segment: [%d/%d]\n", w.id, job.Type, job.Pos, job.Total)
-		}
-		w.downloadSegment(job)
-	case TextSegmentDL, TextPartialSegmentDL:
-		job.wg.Add(1)
-		if Debug {
-			fmt.Printf("-> [W%d] start downloading %s segment: [%d/%d]\n", w.id, job.Type, job.Pos, job.Total)
-		}
+	case VideoSegmentDL, VideoPartialSegmentDL, AudioSegmentDL, AudioPartialSegmentDL,
+		TextSegmentDL, TextPartialSegmentDL:
+		job.logger().Debug("downloading segment", "worker", w.id, "type", job.Type, "segment", job.Pos, "total", job.Total)
 		w.downloadSegment(job)
 	default:
-		Logger.Printf("format: %s not supported by workers\n", job.Type)
+		w.g.logger().Warn("job type not supported by the workers", "type", job.Type)
 		return
 	}
 
 }
 
+// DownloadFromMPDFile downloads the manifest with the workers started by
+// LaunchWorkers. The errors can be checked with errors.Is against
+// ErrManifestFetch, ErrManifestParse, ErrUnsupportedManifest,
+// ErrSegmentDownload, ErrMissingSegments, ErrMux and ErrFFmpegNotFound.
 func DownloadFromMPDFile(manifestURL, pathToUse, outFilename string) error {
-	wg := &sync.WaitGroup{}
-	job := &WJob{
-		Type:     ManifestDL,
-		URL:      manifestURL,
-		DestPath: pathToUse,
-		Filename: outFilename,
-		wg:       wg,
+	if defaultGrabber == nil {
+		return errWorkersNotLaunched
 	}
-	wg.Add(1)
-	DlChan <- job
-	wg.Wait()
+	return defaultGrabber.DownloadContext(defaultCtx, manifestURL, pathToUse, outFilename)
+}
 
-	return job.Err
+// DownloadJob sends a manifest job to the workers started by LaunchWorkers
+// and waits for it to be done, the job report and error are populated.
+func DownloadJob(job *WJob) error {
+	if defaultGrabber == nil {
+		return errWorkersNotLaunched
+	}
+	return defaultGrabber.DownloadJobContext(defaultCtx, job)
 }
 
 func (w *Worker) downloadManifest(job *WJob) {
-	// if Debug {
-	Logger.Println("Downloading manifest file:", job.URL)
-	// }
+	// the jobs sent directly on the channel weren't set up
+	w.g.setup(job)
+	job.events = newJobEvents(job.OnEvent)
+	// the job is identified by its workspace in the logs
+	key := workspaceKey(job.WorkspaceID, job.URL, w.g.workspaceSettings(job))
+	job.log = w.g.logger().With("job", key)
+	job.ctx = withLogger(job.ctx, job.log)
+
+	job.log.Info("downloading the manifest", "url", job.URL)
 	defer func() {
 		if job.wg != nil {
 			job.wg.Done()
-			if Debug {
-				fmt.Println("-> done with the manifest download job")
-			}
+			job.log.Debug("manifest job done")
 		}
 	}()
 
-	manifestPath := filepath.Join(TmpFolder, "manifest.mpd")
+	// the workspace is named after the requested url, not the redirected one
+	manifestURL := job.URL
 
-	// create a custom http client to track and follow redirects
+	// copy the job client to track and follow the manifest redirects
 	// and pass it to the download function
-	client := &http.Client{
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			if req.Response != nil {
-				rURL, err := req.Response.Location()
-				if err == nil {
-					job.URL = rURL.String()
-					Logger.Println("manifest redirected to:", job.URL)
-				}
+	client := *job.client
+	checkRedirect := client.CheckRedirect
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if checkRedirect != nil {
+			if err := checkRedirect(req, via); err != nil {
+				return err
 			}
-			return nil
-		},
+		}
+		if req.Response != nil {
+			rURL, err := req.Response.Location()
+			if err == nil {
+				job.URL = rURL.String()
+				job.log.Info("manifest redirected", "url", job.URL)
+			}
+		}
+		return nil
 	}
 
-	mpdF, err := downloadFileWithClient(client, job.URL, manifestPath)
+	mpdBytes, err := fetchRange(job.ctx, &client, job.URL, "")
 	if err != nil {
-		Logger.Println("failed to download the manifest file")
-		Logger.Println(err)
-		job.Err = err
+		job.log.Error("failed to download the manifest", "url", job.URL, "err", err)
+		job.Err = &ManifestError{Kind: ErrManifestFetch, URL: job.URL, Err: err}
 		return
 	}
 
-	defer func() {
-		mpdF.Close()
-		os.Remove(manifestPath)
-	}()
+	maniURL, _ := url.Parse(job.URL)
 
-	if Debug {
-		fmt.Println("-> Parsing the manifest file", manifestPath)
+	// parse the manifest, resolving its remote elements
+	mpdData, err := parseManifest(job.ctx, job.client, mpdBytes, maniURL)
+	if err != nil {
+		job.Err = &ManifestError{Kind: ErrManifestParse, URL: job.URL, Err: err}
+		job.log.Error("failed to parse the manifest", "err", err)
+		return
 	}
 
-	// rewind the file
-	mpdF.Seek(0, io.SeekStart)
+	job.log.Info("manifest parsed")
 
-	// parse the manifest
-	mpdData, err := mpd.Read(mpdF)
+	ws, err := openWorkspace(w.g.opts.TmpFolder, key, manifestURL, job.log)
 	if err != nil {
-		job.Err = fmt.Errorf("Failed to read the mpd file - %s\n", err)
+		job.Err = err
+		job.log.Error("failed to open the workspace", "err", job.Err)
 		return
 	}
+	job.workspace = ws
+	defer ws.close()
+	defer func() {
+		if job.Err == nil {
+			return
+		}
+		if !ws.hasSegments() {
+			ws.remove()
+			return
+		}
+		job.log.Info("the downloaded segments are kept, run the job again to resume it", "workspace", ws.dir)
+	}()
 
-	if mpdData.Type != nil && (*mpdData.Type == "dynamic") {
-		job.Err = fmt.Errorf("dynamic mpd not supported")
-		return
+	if job.Report == nil {
+		job.Report = &DownloadReport{}
 	}
-	// if Debug {
-	Logger.Println("MPD file parsed")
-	// }
 
-	audioTracks := []*OutputTrack{}
-	videoTracks := []*OutputTrack{}
-	textTracks := []*OutputTrack{}
+	// signed manifest urls can require the same query on all the requests
+	job.urls = newURLRewriter(job, maniURL)
+	// and expire before the end of long downloads
+	job.signing = newURLSigning(job.Signer, job.client, maniURL, w.g.filter)
 
-	maniURL, _ := url.Parse(job.URL)
-	var baseURL *url.URL
+	// the hosts failing are avoided for the rest of the job
+	job.hosts = newHostHealth()
+	// and the content steering server can reorder them while we download
+	job.hosts.steering = newContentSteering(job.client, mpdData, maniURL, job.log)
+	job.hosts.steering.start(job.ctx)
+	defer job.hosts.steering.close()
 
-	if len(mpdData.BaseURL) == 0 {
-		baseURL = maniURL
-	} else {
-		baseURL = absBaseURL(maniURL, mpdData.BaseURL)
-		if Debug {
-			fmt.Println("-> Base URL", baseURL.String())
-		}
-	}
+	periods := newPeriodFilter(job.skipAds, w.g.adDetection(), job.Report, job.log)
+	defer logSkippedPeriods(job.log, job.Report)
 
-	tmpBaseURL := baseURL
-	for _, period := range mpdData.Periods {
-		if Debug {
-			fmt.Printf("-> Period ID: %s, duration: %s\n", period.ID, time.Duration(period.Duration).String())
-		}
+	selections := periods.filter(mpdData, maniURL, selectTracks(mpdData, maniURL, w.g.filter, job.log))
+	split := w.g.opts.SplitPeriods && !mpdData.isDynamic()
+	planned := plannedTracks(selections, split, job.log)
+	job.events.manifestParsed(planned)
 
-		if len(period.BaseURL) > 0 {
-			tmpBaseURL = absBaseURL(tmpBaseURL, period.BaseURL)
-			if Debug {
-				fmt.Printf("-> Base URL:%s", tmpBaseURL.String())
-				fmt.Println()
-			}
-		}
+	if mpdData.isDynamic() {
+		atomic.StoreInt32(&job.live, 1)
+		defer atomic.StoreInt32(&job.live, 0)
+		w.recordLive(job, mpdData, maniURL, periods)
+		return
+	}
+	if len(planned) == 0 {
+		job.Err = &ManifestError{Kind: ErrUnsupportedManifest, URL: job.URL, Err: errors.New("no supported track to download")}
+		job.log.Error("no supported track to download")
+		return
+	}
 
-		for _, adaptationSet := range period.AdaptationSets {
-			contentType := extractContentType(adaptationSet.ContentType, adaptationSet.MimeType)
-			if contentType == UnknownString {
-				availableTypes := representationTypes(adaptationSet.Representations)
-				if len(availableTypes) == 1 {
-					contentType = availableTypes[0]
-				}
+	if split {
+		// one output file per period
+		var periodKeys []string
+		periodTracks := map[string][]*trackSelection{}
+		for _, sel := range selections {
+			if _, ok := periodTracks[sel.PeriodKey]; !ok {
+				periodKeys = append(periodKeys, sel.PeriodKey)
 			}
-			setBaseURL := absBaseURL(tmpBaseURL, adaptationSet.BaseURL)
-			// populate the adaptation set in the representation
-			for i := range adaptationSet.Representations {
-				adaptationSet.Representations[i].AdaptationSet = adaptationSet
+			periodTracks[sel.PeriodKey] = append(periodTracks[sel.PeriodKey], sel)
+		}
+		for i, periodKey := range periodKeys {
+			job.log.Info("downloading period", "period", periodKey, "index", i+1, "periods", len(periodKeys))
+			prefix := "p" + strconv.Itoa(i) + "_"
+			tracks := &outputTracks{}
+			for _, sel := range periodTracks[periodKey] {
+				downloadTrack(job, mpdData, []*trackSelection{sel}, prefix, tracks)
 			}
-
-			if shouldSkipLang(strPtrtoS(adaptationSet.Lang)) {
-				if Debug {
-					fmt.Printf("-> Skipping adaptation %s, [%s] because Lang: %s {allowed: %s}\n",
-						strPtrtoS(adaptationSet.ID),
-						contentType,
-						strPtrtoS(adaptationSet.Lang),
-						strings.Join(LangFilter, ","),
-					)
-				}
-				continue
+			if job.Err != nil {
+				return
 			}
-
-			if shouldSkipContentType(contentType) {
-				if Debug {
-					fmt.Printf("-> Skipping adaptation %s, [%s] because content type filtering {allowed: %s}\n",
-						strPtrtoS(adaptationSet.ID),
-						contentType,
-						strings.Join(allowedContentTypes(), ","),
-					)
-				}
-				continue
+			if tracks.empty() {
+				job.Err = errNoSegments(job)
+				job.log.Error("no segments to download", "period", periodKey)
+				return
 			}
-
-			if Debug {
-				debugPrintAdaptationSet(setBaseURL, contentType, adaptationSet)
+			muxTracks(job, job.Filename+"_"+filenameCleaner.Replace(periodKey), tracks)
+			if job.Err != nil {
+				// the next periods would fail the same way
+				return
 			}
+		}
+		if job.Err == nil {
+			ws.remove()
+		}
+		return
+	}
 
-			r := highestRepresentation(contentType, adaptationSet.Representations)
-			if Debug {
-				fmt.Println("\tBest representation:")
-				debugPrintRepresentation(setBaseURL, contentType, r)
-				fmt.Println()
-			}
+	// adaptation sets continuing across periods are stitched into one track
+	groups := newTrackGroups(job.log)
+	for _, sel := range selections {
+		groups.add(sel)
+	}
+	tracks := &outputTracks{}
+	for _, group := range groups.groups {
+		downloadTrack(job, mpdData, group.tracks, "", tracks)
+	}
+	if job.Err != nil {
+		// a partial download isn't muxed
+		return
+	}
+	if tracks.empty() {
+		job.Err = errNoSegments(job)
+		job.log.Error("no segments to download")
+		return
+	}
 
-			if r == nil {
-				Logger.Println("no representation found for adaptation set:", strPtrtoS(adaptationSet.ID))
-				continue
-			}
+	muxTracks(job, job.Filename, tracks)
+	if job.Err == nil {
+		ws.remove()
+	}
+}
 
-			rBaseURL := absBaseURL(setBaseURL, r.BaseURL)
-
-			switch contentType {
-			case "video":
-				Logger.Printf("Downloading Video Track: %s", strPtrtoS(r.ID))
-				downloadVideoRepresentation(job, rBaseURL, r, &videoTracks)
-			case "audio":
-				Logger.Printf("Downloading Audio Stream: %s", strPtrtoS(r.ID))
-				downloadAudioRepresentation(job, rBaseURL, r, &audioTracks)
-			case "text":
-				Logger.Printf("Downloading Text Stream: %s", strPtrtoS(r.ID))
-				downloadTextRepresentation(job, rBaseURL, r, &textTracks)
-			default:
-				Logger.Println("unknown content type:", contentType)
+// plannedTracks describes the tracks the selections are downloaded as, the
+// adaptation sets continuing across periods are stitched unless split.
+func plannedTracks(selections []*trackSelection, split bool, log *slog.Logger) []TrackInfo {
+	var tracks []TrackInfo
+	if split {
+		for _, sel := range selections {
+			if _, ok := contentTypeFor(sel.ContentType); ok {
+				tracks = append(tracks, newTrackInfo([]*trackSelection{sel}))
 			}
-
 		}
+		return tracks
 	}
-
-	outputPath := filepath.Join(job.DestPath, job.Filename) + ".mkv"
-	err = Mux(outputPath, audioTracks, videoTracks, textTracks)
-	if err != nil {
-		Logger.Println("Failed to mux streams:", err)
-		os.Exit(1)
+	groups := newTrackGroups(log)
+	for _, sel := range selections {
+		groups.add(sel)
 	}
-	Logger.Printf("Created %s\n", outputPath)
-
+	for _, group := range groups.groups {
+		if _, ok := contentTypeFor(group.tracks[0].ContentType); ok {
+			tracks = append(tracks, newTrackInfo(group.tracks))
+		}
+	}
+	return tracks
 }
 
-func downloadVideoRepresentation(job *WJob, baseURL *url.URL, r *mpd.Representation, videoTracks *[]*OutputTrack) {
-	downloadRepresentation(job, baseURL, r, ContentTypeVideo, videoTracks)
+func logSkippedPeriods(log *slog.Logger, report *DownloadReport) {
+	for _, p := range report.SkippedPeriods() {
+		log.Info("skipped period", "period", p.ID, "start", p.Start, "duration", p.Duration, "reason", p.Reason)
+	}
 }
 
-func downloadAudioRepresentation(job *WJob, baseURL *url.URL, r *mpd.Representation, audioTracks *[]*OutputTrack) {
-	downloadRepresentation(job, baseURL, r, ContentTypeAudio, audioTracks)
+// outputTracks are the reassembled tracks of a manifest job, by media type.
+type outputTracks struct {
+	audio []*OutputTrack
+	video []*OutputTrack
+	text  []*OutputTrack
 }
 
-func downloadTextRepresentation(job *WJob, baseURL *url.URL, r *mpd.Representation, textTracks *[]*OutputTrack) {
-	downloadRepresentation(job, baseURL, r, ContentTypeText, textTracks)
+func (o *outputTracks) add(track *OutputTrack) {
+	switch track.MediaType {
+	case ContentTypeAudio:
+		o.audio = append(o.audio, track)
+	case ContentTypeVideo:
+		o.video = append(o.video, track)
+	case ContentTypeText:
+		o.text = append(o.text, track)
+	}
 }
 
-func downloadRepresentation(job *WJob, baseURL *url.URL, r *mpd.Representation, cType ContentType, outputTracks *[]*OutputTrack) {
-
-	var outPath string
-	if isSegmentBase(r) {
-		// 1 big file for the entire representation, no need to assemble segments
-		outFilename := filepath.Base(baseURL.Path)
-		outPath := filepath.Join(TmpFolder, outFilename)
-		var jobType WJobType
-		switch cType {
-		case ContentTypeAudio:
-			jobType = AudioSegmentDL
-		case ContentTypeVideo:
-			jobType = VideoSegmentDL
-		case ContentTypeText:
-			jobType = TextSegmentDL
-		default:
-			Logger.Println("unknown content type:", cType)
-			return
-		}
-
-		Logger.Printf("(1 %s segment)\n", cType)
-		job := &WJob{
-			Type:         jobType,
-			URL:          baseURL.String(),
-			AbsolutePath: outPath,
-			Filename:     outFilename,
-			wg:           job.wg,
-			Total:        1,
-		}
-		segChan <- job
+func (o *outputTracks) empty() bool {
+	return len(o.audio)+len(o.video)+len(o.text) == 0
+}
 
-	} else {
-		suffix := "_seg_"
-		// must be set by the segment list or segment template code sections
-		nbrSegments := 0
-		tmpFilenamePattern := ""
-		var jobType WJobType
-		switch cType {
-		case ContentTypeAudio:
-			jobType = AudioPartialSegmentDL
-		case ContentTypeVideo:
-			jobType = VideoPartialSegmentDL
-		case ContentTypeText:
-			jobType = TextPartialSegmentDL
-		default:
-			Logger.Println("unknown content type:", cType)
-			return
-		}
+// errNoSegments is the error of the jobs whose tracks have no segment to
+// download.
+func errNoSegments(job *WJob) error {
+	return &ManifestError{Kind: ErrUnsupportedManifest, URL: job.URL, Err: errors.New("no segments to download")}
+}
 
-		// Segment list
-		if r.SegmentList != nil && r.SegmentList.SegmentURLs != nil && len(r.SegmentList.SegmentURLs) > 0 {
-			// raw segment list
-
-			// we use a dedicated to wait for the entire segment list to be downloaded
-			segWG := &sync.WaitGroup{}
-			nbrSegments = len(r.SegmentList.SegmentURLs)
-			tmpFilenamePattern = filepath.Base(strPtrtoS(r.SegmentList.SegmentURLs[0].Media)) + suffix
-			var outFilename string
-			var path string
-
-			Logger.Printf("(%d %s segments)\n", nbrSegments, cType)
-			for i, segURL := range r.SegmentList.SegmentURLs {
-				outFilename = tmpFilenamePattern + strconv.Itoa(i)
-				path = filepath.Join(TmpFolder, outFilename)
-
-				job := &WJob{
-					Type:         jobType,
-					Pos:          i,
-					Total:        nbrSegments,
-					URL:          strPtrtoS(segURL.Media),
-					AbsolutePath: path,
-					Filename:     outFilename,
-					wg:           segWG,
-				}
-				segChan <- job
-			}
-			segWG.Wait()
-
-		} else if isTemplated(r) {
-			// templated segment list
-			segURLs := templatedSegments(baseURL, r)
-			nbrSegments = len(segURLs)
-			if len(segURLs) > 0 {
-				tmpFilenamePattern = filepath.Base(segURLs[0]) + suffix
-				segWG := &sync.WaitGroup{}
-				Logger.Printf("(%d %s segments)\n", nbrSegments, cType)
-
-				for i, segurl := range segURLs {
-					outFilename := tmpFilenamePattern + strconv.Itoa(i)
-					path := filepath.Join(TmpFolder, outFilename)
-
-					job := &WJob{
-						Type:         jobType,
-						Pos:          i,
-						Total:        nbrSegments,
-						URL:          segurl,
-						AbsolutePath: path,
-						Filename:     outFilename,
-						wg:           segWG,
-					}
-					segChan <- job
+// muxTracks muxes the downloaded tracks into filename (without extension)
+// in the destination folder of the job.
+func muxTracks(job *WJob, filename string, tracks *outputTracks) {
+	outputPath := filepath.Join(job.DestPath, filename) + ".mkv"
+	job.events.mux(outputPath, false, nil)
+	err := MuxContext(job.ctx, outputPath, tracks.audio, tracks.video, tracks.text)
+	job.events.mux(outputPath, true, err)
+	if err != nil {
+		job.Err = fmt.Errorf("failed to mux the streams - %w", err)
+		job.log.Error("failed to mux the streams", "path", outputPath, "err", err)
+		return
+	}
+	job.log.Info("created the output file", "path", outputPath)
+}
 
-				}
-				segWG.Wait()
-			}
+// contentTypeFor maps a DASH content type to the supported media types.
+func contentTypeFor(contentType string) (ContentType, bool) {
+	switch contentType {
+	case "video":
+		return ContentTypeVideo, true
+	case "audio":
+		return ContentTypeAudio, true
+	case "text":
+		return ContentTypeText, true
+	}
+	return 0, false
+}
 
-			if nbrSegments > 0 {
-				outFilename := tmpFilenamePattern[:len(tmpFilenamePattern)-5]
-				// the track to reassemble
-				tempPathPattern := filepath.Join(TmpFolder, outFilename)
-				ext := guessedExtension(r)
-				outPath = tempPathPattern + ext
-				Logger.Printf("Reconstructing sub %s file: %s\n", cType, filepath.Base(outPath))
-				err := reassembleFile(tempPathPattern, suffix, outPath, len(segURLs), cType)
-				if err != nil {
-					job.Err = fmt.Errorf("error reassembling file: %s - %v", outPath, err)
-					Logger.Println(job.Err)
-					return
-				}
-			}
+// downloadTrack downloads the segments of the selected representations, one
+// per period, and reassembles them into a single track file added to tracks.
+func downloadTrack(job *WJob, m *manifest, selections []*trackSelection, prefix string, tracks *outputTracks) {
+	if err := job.ctx.Err(); err != nil {
+		// the job was cancelled, the remaining tracks aren't started
+		job.Err = err
+		return
+	}
+	track, err := downloadRepresentations(job, m, selections, prefix)
+	if err != nil {
+		job.Err = err
+		job.log.Error("failed to download the track", "err", job.Err)
+		return
+	}
+	if track != nil {
+		tracks.add(track)
+	}
+}
 
-		} else {
-			Logger.Printf("track is not in a supported format, AS ID: %s, Rep ID: %s", strPtrtoS(r.AdaptationSet.ID), strPtrtoS(r.ID))
-			return
+func downloadRepresentations(job *WJob, m *manifest, selections []*trackSelection, prefix string) (*OutputTrack, error) {
+	first := selections[0]
+	r := first.Representation
+	cType, ok := contentTypeFor(first.ContentType)
+	if !ok {
+		job.log.Warn("unknown content type", "content_type", first.ContentType)
+		return nil, nil
+	}
+	info := newTrackInfo(selections)
+	log := job.log.With("track", info.ID)
+	log.Info("downloading track", "content_type", cType, "representation", strPtrtoS(r.ID))
+
+	periodSegments := make([][]*Segment, len(selections))
+	var nbrSegments int
+	for i, sel := range selections {
+		segments, err := representationSegments(job.ctx, job.client, m, sel.Period, sel.BaseURL, sel.Representation, job.urls)
+		if err != nil {
+			return nil, segmentListingError(job.URL, fmt.Errorf("failed to list the segments of representation %s (period %s) - %w", strPtrtoS(sel.Representation.ID), sel.PeriodKey, err))
 		}
-
-		if outPath != "" {
-			at := &OutputTrack{
-				RepresentationID: strPtrtoS(r.ID),
-				BaseURL:          baseURL.String(),
-				Language:         strPtrtoS(r.AdaptationSet.Lang),
-				AbsolutePath:     outPath,
-				Codec:            repCodecs(r),
-				SampleRate:       int64PtrToI(r.AudioSamplingRate),
-				MediaType:        ContentTypeAudio,
-			}
-
-			*outputTracks = append(*outputTracks, at)
+		// the segments can be downloaded from the other BaseURLs if needed
+		addSegmentMirrors(segments, sel)
+		job.hosts.register(sel.BaseURLs)
+		job.signing.register(sel)
+		periodSegments[i] = segments
+		nbrSegments += len(segments)
+	}
+	if nbrSegments == 0 {
+		log.Warn("no segments found", "representation", strPtrtoS(r.ID))
+		return nil, nil
+	}
+	log.Info("segments listed", "segments", nbrSegments, "periods", len(selections))
+	td := newTrackDownload(r, cType, first.BaseURL)
+	td.prefix = prefix
+	td.hosts = job.hosts
+	td.signing = job.signing
+	td.client = job.client
+	td.retry = job.retry
+	td.sizeTolerance = job.grabber.opts.SegmentSizeTolerance
+	td.workspace = job.workspace
+	td.segments = job.grabber.segments
+	td.ctx = job.ctx
+	td.events = job.events
+	td.info = info
+	td.log = log
+	td.single = nbrSegments == 1
+	for i, sel := range selections {
+		// the periods are reassembled separately unless they are continuous
+		if i > 0 {
+			td.startPeriod(sel.continues(selections[i-1]))
 		}
+		td.queue(sel.BaseURL, periodSegments[i]...)
 	}
+	return td.assemble()
 }
 
 func (w *Worker) downloadSegment(job *WJob) {
-	// if Debug {
-	// 	fmt.Println("-> Downloading segment:", job.URL, "to", job.AbsolutePath)
-	// }
 	defer func() {
 		if job.wg != nil {
 			job.wg.Done()
 		}
 	}()
 
-	if fileExists(job.AbsolutePath) {
-		Logger.Println("File already present", job.AbsolutePath)
+	ctx := job.ctx
+	if ctx == nil {
+		ctx = context.Background()
 	}
-
-	audioF, err := downloadFile(job.URL, job.AbsolutePath)
-	if err != nil {
-		Logger.Printf("Failed to download the %s segment file\n", job.Type)
-		Logger.Println(err)
+	if err := ctx.Err(); err != nil {
+		job.Err = err
+		return
+	}
+	retry := job.retry
+	if retry == nil {
+		defaults := DefaultRetryOptions
+		retry = &defaults
+	}
+	log := job.logger()
+	job.events.segmentStarted(job)
+	var segF *os.File
+	var err error
+	for attempt := 1; ; attempt++ {
+		job.attempts = attempt
+		segF, err = w.downloadSegmentMirrors(ctx, job)
+		if err == nil || ctx.Err() != nil || !isRetryable(err) || attempt > retry.MaxRetries {
+			break
+		}
+		delay := retry.retryDelay(attempt, err)
+		log.Warn("failed to download the segment, retrying", "segment", job.Pos, "url", job.URL, "retry", attempt, "max_retries", retry.MaxRetries, "delay", delay.Round(time.Millisecond), "err", err)
+		job.events.segmentRetried(job, delay, err)
+		if err = sleepContext(ctx, delay); err != nil {
+			break
+		}
 	}
-	if Debug {
-		fmt.Printf("-> [W%d] done downloading %s segment [%d/%d]\n", w.id, job.Type, job.Pos, job.Total)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		// the request was aborted, not failed
+		err = ctxErr
+	} else if err != nil {
+		log.Error("failed to download the segment", "segment", job.Pos, "url", job.URL, "attempts", job.attempts, "err", err)
+		job.events.segmentFailed(job, err)
+	}
+	log.Debug("segment job done", "worker", w.id, "segment", job.Pos, "total", job.Total)
+	if segF != nil {
+		var size int64
+		if info, statErr := segF.Stat(); statErr == nil {
+			size = info.Size()
+			job.workspace.complete(job.Filename, job.segmentKey, size)
+		}
+		segF.Close()
+		job.events.segmentCompleted(job, size)
 	}
-	audioF.Close()
 	job.Err = err
 }
 
+// downloadSegmentMirrors downloads the segment, falling back on the
+// alternative BaseURLs, healthy hosts first.
+func (w *Worker) downloadSegmentMirrors(ctx context.Context, job *WJob) (*os.File, error) {
+	urls := job.hosts.order(append([]string{job.URL}, job.Mirrors...))
+	var segF *os.File
+	var err error
+	for i, segURL := range urls {
+		segF, err = w.downloadSegmentURL(ctx, job, segURL)
+		if err == nil {
+			if segURL != job.URL {
+				job.logger().Debug("segment downloaded from a mirror", "worker", w.id, "segment", job.Pos, "url", segURL)
+			}
+			return segF, nil
+		}
+		if ctx.Err() != nil {
+			// the host didn't fail, the job was cancelled
+			return nil, err
+		}
+		if isHostFailure(err) {
+			job.hosts.fail(segURL)
+		}
+		if i+1 < len(urls) {
+			job.logger().Warn("failed to download the segment, trying the next host", "segment", job.Pos, "host", hostOf(segURL), "next_host", hostOf(urls[i+1]), "err", err)
+		}
+	}
+	return nil, err
+}
+
+// downloadSegmentURL downloads the segment from segURL, the request is retried
+// once with a fresh url if the server rejects the signature of the url.
+func (w *Worker) downloadSegmentURL(ctx context.Context, job *WJob, segURL string) (*os.File, error) {
+	// the base url might have been renewed since the segment was queued
+	segURL = job.signing.current(segURL)
+	f, err := downloadFileRequest(ctx, job.client, segURL, job.ByteRange, job.signing.requestHeader(), job.AbsolutePath, job.payload)
+	statusErr, ok := retryableAuthError(err)
+	if !ok {
+		return f, err
+	}
+	signedURL, signErr := job.signing.resign(ctx, segURL, statusErr.StatusCode)
+	if signErr != nil {
+		return nil, fmt.Errorf("%w - %v", err, signErr)
+	}
+	log := job.logger()
+	log.Info("segment rejected, retrying with a fresh url", "segment", job.Pos, "status", statusErr.Status)
+	log.Debug("segment url signed", "worker", w.id, "segment", job.Pos, "url", signedURL)
+	return downloadFileRequest(ctx, job.client, signedURL, job.ByteRange, job.signing.requestHeader(), job.AbsolutePath, job.payload)
+}
+
+// sleepContext waits for d or until ctx is done, it returns the error of ctx
+// in the latter case.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func representationTypes(representations []*mpd.Representation) []string {
 	typesMap := map[string]bool{}
 	for _, r := range representations {
@@ -537,7 +717,7 @@ func representationTypes(representations []*mpd.Representation) []string {
 	return t
 }
 
-func highestRepresentation(contentType string, representations []*mpd.Representation) *mpd.Representation {
+func highestRepresentation(contentType string, representations []*mpd.Representation, log *slog.Logger) *mpd.Representation {
 	var highestBandwidth int64
 	var highestWidth int64
 	var highestRep *mpd.Representation
@@ -547,7 +727,7 @@ func highestRepresentation(contentType string, representations []*mpd.Representa
 		if len(availableTypes) == 1 {
 			contentType = availableTypes[0]
 		} else {
-			Logger.Printf("multiple content types found: %s", strings.Join(availableTypes, ", "))
+			log.Warn("multiple content types found", "content_types", strings.Join(availableTypes, ", "))
 			return nil
 		}
 	}
@@ -594,7 +774,7 @@ func highestRepresentation(contentType string, representations []*mpd.Representa
 	}
 
 	if highestRep == nil {
-		Logger.Println("No highest representation found for content type", contentType, "picking the last one")
+		log.Warn("no highest representation found, picking the last one", "content_type", contentType)
 		// pick the last one, hoping it's the highest quality
 		highestRep = representations[len(representations)-1]
 	}
@@ -602,107 +782,11 @@ func highestRepresentation(contentType string, representations []*mpd.Representa
 	return highestRep
 }
 
-func isSegmentBase(r *mpd.Representation) bool {
-
-	/*
-		  See https://bitmovin.com/dynamic-adaptive-streaming-http-mpeg-dash/#:~:text=4%3A%20Segment%20Referencing%20Schemes
-
-			A representation should only contain one of the following options:
-			* one or more SegmentList elements
-			* one SegmentTemplate
-			* one or more BaseURL elements, at most one SegmentBase element and no SegmentTemplate or SegmentList element.
-	*/
-
-	if r.SegmentBase != nil {
-		return true
-	}
-
-	if r.SegmentList != nil {
-		return false
-	}
-
-	if r.SegmentTemplate != nil {
-		return false
-	}
-
-	// check the parent segmentTemplate
-	if r.AdaptationSet != nil && r.AdaptationSet.SegmentTemplate != nil {
-		return false
-	}
-
-	if len(r.BaseURL) == 0 {
-		return false
-	}
-
-	return true
-}
-
-func isTemplated(r *mpd.Representation) bool {
-	if r.SegmentTemplate != nil {
-		return true
-	}
-
-	if r.AdaptationSet != nil && r.AdaptationSet.SegmentTemplate != nil {
-		return true
-	}
-
-	return false
-}
-
-func shouldSkipLang(lang string) bool {
-	if lang == "" || lang == "und" || lang == UnknownString {
-		return false
-	}
-
-	if len(LangFilter) == 0 {
-		return false
-	}
-
-	for _, l := range LangFilter {
-		if l == lang {
-			return false
-		}
-	}
-
-	return true
-}
-
-func shouldSkipContentType(contentType string) bool {
-	// filter content types based on download flags
-	switch contentType {
-	case "video":
-		if !VideoDownloadEnabled {
-			return true
-		}
-	case "audio":
-		if !AudioDownloadEnabled {
-			return true
-		}
-	case "text":
-		if !TextDownloadEnabled {
-			return true
-		}
-	}
-	return false
-}
-
-func allowedContentTypes() []string {
-	var allowed []string
-	if VideoDownloadEnabled {
-		allowed = append(allowed, "video")
-	}
-	if AudioDownloadEnabled {
-		allowed = append(allowed, "audio")
-	}
-	if TextDownloadEnabled {
-		allowed = append(allowed, "text")
-	}
-	return allowed
-}
-
 // Close closes the open channels to stop the workers cleanly
 func Close() {
-	close(DlChan)
+	if defaultGrabber != nil {
+		defaultGrabber.closeJobs()
+	}
 }
 
 type OutputTrack struct {
@@ -0,0 +1,57 @@
+package mpdgrabber
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSplitPeriodsStopAfterAMuxFailure(t *testing.T) {
+	var mu sync.Mutex
+	var requested []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/manifest.mpd" {
+			w.Write([]byte(`<?xml version="1.0"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static" mediaPresentationDuration="PT8S">
+  <Period id="first" start="PT0S">
+    <AdaptationSet mimeType="audio/mp4"><SegmentTemplate initialization="first/init.mp4" media="first/$Number$.m4s" duration="2" timescale="1"/><Representation id="a" bandwidth="1000"/></AdaptationSet>
+  </Period>
+  <Period id="second" start="PT4S">
+    <AdaptationSet mimeType="audio/mp4"><SegmentTemplate initialization="second/init.mp4" media="second/$Number$.m4s" duration="2" timescale="1"/><Representation id="a" bandwidth="1000"/></AdaptationSet>
+  </Period>
+</MPD>`))
+			return
+		}
+		mu.Lock()
+		requested = append(requested, r.URL.Path)
+		mu.Unlock()
+		// an empty mp4 box
+		w.Write([]byte("\x00\x00\x00\x08free"))
+	}))
+	defer srv.Close()
+	// ffmpeg isn't installed, the first period can't be muxed
+	t.Setenv("PATH", t.TempDir())
+
+	g, err := NewGrabber(Options{TmpFolder: t.TempDir(), SplitPeriods: true, SegmentSizeTolerance: -1, Logger: discardLogger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	err = g.Download(srv.URL+"/manifest.mpd", t.TempDir(), "out")
+	if !errors.Is(err, ErrFFmpegNotFound) {
+		t.Fatalf("Download() = %v, want %v", err, ErrFFmpegNotFound)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requested) == 0 {
+		t.Fatal("the first period wasn't downloaded")
+	}
+	for _, path := range requested {
+		if strings.HasPrefix(path, "/second/") {
+			t.Errorf("%s was downloaded after the first period failed to mux", path)
+		}
+	}
+}
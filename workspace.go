@@ -0,0 +1,314 @@
+package mpdgrabber
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	stateFilename = "state.json"
+	// stateSaveInterval limits how often the state file is written while the
+	// segments complete, the state is always saved once a track is done.
+	stateSaveInterval = time.Second
+)
+
+// workspace is the folder of a job, named after the manifest url or the id
+// of the job so running the same job again resumes the download. The state
+// file records the selected representations and the downloaded segments.
+type workspace struct {
+	dir string
+	log *slog.Logger
+
+	mu       sync.Mutex
+	state    *workspaceState
+	lastSave time.Time
+}
+
+type workspaceState struct {
+	ManifestURL string `json:"manifest_url"`
+	// Tracks are the selected representations, by filename prefix
+	Tracks map[string]*trackState `json:"tracks"`
+	// Segments are the downloaded segments, by filename
+	Segments map[string]*segmentState `json:"segments"`
+}
+
+type trackState struct {
+	RepresentationID string `json:"representation_id"`
+	ContentType      string `json:"content_type"`
+	Segments         int    `json:"segments"`
+}
+
+type segmentState struct {
+	// Key identifies the segment, see segmentKey
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+}
+
+// segmentKey identifies a segment across runs: its url relative to the
+// BaseURL it's resolved against, without query. The filename of the segment
+// gives its position in the track.
+// The BaseURL isn't part of the key since the weighted BaseURLs are picked
+// randomly and the tokens of the query change between runs.
+func segmentKey(segURL string, base *url.URL) string {
+	key := stripQuery(segURL)
+	if base == nil {
+		return key
+	}
+	return strings.TrimPrefix(key, baseDir(base))
+}
+
+// workspaceKey returns the name of the workspace of a job, the id set by the
+// user or a hash of the manifest url without its query and of the settings
+// selecting what's downloaded: the jobs downloading other tracks of the same
+// manifest don't share their segments.
+func workspaceKey(id, manifestURL, settings string) string {
+	if id != "" {
+		return filenameCleaner.Replace(id)
+	}
+	sum := sha1.Sum([]byte(stripQuery(manifestURL) + "\n" + settings))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+// openWorkspaces are the workspace folders used by the jobs of the process,
+// a workspace is used by one job at a time.
+var openWorkspaces = struct {
+	sync.Mutex
+	dirs map[string]bool
+}{dirs: map[string]bool{}}
+
+func stripQuery(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	u.RawQuery, u.Fragment = "", ""
+	return u.String()
+}
+
+// openWorkspace creates the workspace folder or loads the state of the
+// previous run, close releases it.
+func openWorkspace(root, key, manifestURL string, log *slog.Logger) (*workspace, error) {
+	dir := filepath.Join(root, key)
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	ws := &workspace{
+		dir: dir,
+		log: log,
+		state: &workspaceState{
+			ManifestURL: stripQuery(manifestURL),
+			Tracks:      map[string]*trackState{},
+			Segments:    map[string]*segmentState{},
+		},
+	}
+	openWorkspaces.Lock()
+	defer openWorkspaces.Unlock()
+	if openWorkspaces.dirs[ws.dir] {
+		return nil, fmt.Errorf("%w %s", ErrWorkspaceInUse, ws.dir)
+	}
+	if err := ws.load(); err != nil {
+		return nil, err
+	}
+	openWorkspaces.dirs[ws.dir] = true
+	return ws, nil
+}
+
+// close releases the workspace folder, another job can use it.
+func (ws *workspace) close() {
+	if ws == nil {
+		return
+	}
+	openWorkspaces.Lock()
+	delete(openWorkspaces.dirs, ws.dir)
+	openWorkspaces.Unlock()
+}
+
+// load creates the workspace folder and reads the state of the previous run.
+func (ws *workspace) load() error {
+	if err := os.MkdirAll(ws.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create the workspace %s - %w", ws.dir, err)
+	}
+
+	data, err := os.ReadFile(ws.path(stateFilename))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read the workspace state - %w", err)
+	}
+	state := &workspaceState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		ws.log.Warn("invalid workspace state, starting over", "path", ws.path(stateFilename), "err", err)
+		return nil
+	}
+	if state.ManifestURL != ws.state.ManifestURL {
+		ws.log.Warn("workspace used for another manifest, starting over", "workspace", ws.dir, "url", state.ManifestURL)
+		return nil
+	}
+	if state.Tracks == nil {
+		state.Tracks = map[string]*trackState{}
+	}
+	if state.Segments == nil {
+		state.Segments = map[string]*segmentState{}
+	}
+	ws.state = state
+	ws.log.Info("resuming the download", "workspace", ws.dir, "segments", len(state.Segments))
+	return nil
+}
+
+// path returns the path of a file of the workspace, TmpFolder is used
+// without workspace.
+func (ws *workspace) path(filename string) string {
+	if ws == nil {
+		return filepath.Join(TmpFolder, filename)
+	}
+	return filepath.Join(ws.dir, filename)
+}
+
+// reset drops the previous state, live recordings can't be resumed.
+// Every segment file of the folder is removed, not only the ones listed in
+// the state which can be behind after the process was killed.
+func (ws *workspace) reset() {
+	if ws == nil {
+		return
+	}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	entries, err := os.ReadDir(ws.dir)
+	if err != nil {
+		ws.log.Warn("failed to list the workspace", "workspace", ws.dir, "err", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.Contains(entry.Name(), segmentSuffix) {
+			continue
+		}
+		if err := os.Remove(ws.path(entry.Name())); err != nil {
+			ws.log.Warn("failed to remove a previous segment", "path", ws.path(entry.Name()), "err", err)
+		}
+	}
+	ws.state.Tracks = map[string]*trackState{}
+	ws.state.Segments = map[string]*segmentState{}
+	ws.saveLocked()
+}
+
+// registerTrack records a selected representation, the filenames of its
+// segments start with prefix.
+func (ws *workspace) registerTrack(prefix, representationID string, cType ContentType, segments int) {
+	if ws == nil {
+		return
+	}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.state.Tracks[prefix] = &trackState{
+		RepresentationID: representationID,
+		ContentType:      cType.String(),
+		Segments:         segments,
+	}
+	ws.saveLocked()
+}
+
+// verify reports if the segment was downloaded by a previous run and is
+// still complete on disk: same key, same size and, for mp4 segments,
+// complete boxes. Stale or partial files are removed.
+func (ws *workspace) verify(filename, key string, mp4 bool) bool {
+	if ws == nil {
+		return false
+	}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	path := ws.path(filename)
+	info, err := os.Stat(path)
+	if err != nil {
+		delete(ws.state.Segments, filename)
+		return false
+	}
+	seg, ok := ws.state.Segments[filename]
+	if ok && seg.Key == key && seg.Size == info.Size() {
+		if !mp4 {
+			return true
+		}
+		err = validateMP4Boxes(path)
+		if err == nil {
+			return true
+		}
+	}
+	if err != nil {
+		ws.log.Warn("discarding the corrupted segment", "path", path, "err", err)
+	} else {
+		ws.log.Debug("discarding the incomplete segment", "path", path)
+	}
+	delete(ws.state.Segments, filename)
+	os.Remove(path)
+	return false
+}
+
+// complete records a downloaded segment.
+func (ws *workspace) complete(filename, key string, size int64) {
+	if ws == nil {
+		return
+	}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.state.Segments[filename] = &segmentState{Key: key, Size: size}
+	if time.Since(ws.lastSave) >= stateSaveInterval {
+		ws.saveLocked()
+	}
+}
+
+// hasSegments reports whether a segment was downloaded, in this run or a
+// previous one.
+func (ws *workspace) hasSegments() bool {
+	if ws == nil {
+		return false
+	}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return len(ws.state.Segments) > 0
+}
+
+func (ws *workspace) save() {
+	if ws == nil {
+		return
+	}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.saveLocked()
+}
+
+// saveLocked writes the state file atomically, the previous state stays in
+// place if the process dies while writing it.
+func (ws *workspace) saveLocked() {
+	ws.lastSave = time.Now()
+	data, err := json.MarshalIndent(ws.state, "", "  ")
+	if err != nil {
+		ws.log.Error("failed to encode the workspace state", "err", err)
+		return
+	}
+	tmpPath := ws.path(stateFilename + ".tmp")
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		ws.log.Error("failed to save the workspace state", "err", err)
+		return
+	}
+	if err := os.Rename(tmpPath, ws.path(stateFilename)); err != nil {
+		ws.log.Error("failed to save the workspace state", "err", err)
+	}
+}
+
+// remove deletes the workspace once the job is done.
+func (ws *workspace) remove() {
+	if ws == nil {
+		return
+	}
+	if err := os.RemoveAll(ws.dir); err != nil {
+		ws.log.Warn("failed to remove the workspace", "workspace", ws.dir, "err", err)
+	}
+}
@@ -0,0 +1,153 @@
+package mpdgrabber
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWorkspaceResetRemovesUnlistedSegments(t *testing.T) {
+	root := t.TempDir()
+	ws, err := openWorkspace(root, "live", "https://example.com/live.mpd", discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed := "video_1_seg.m4s_seg_1"
+	ws.complete(listed, "seg_1.m4s", 4)
+	ws.save()
+	// written after the last save of the state, before the process was killed
+	unlisted := []string{"video_1_seg.m4s_seg_2", "video_1_seg.m4s_seg_3.part"}
+	for _, filename := range append(unlisted, listed) {
+		if err := os.WriteFile(filepath.Join(ws.dir, filename), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ws.close()
+
+	ws, err = openWorkspace(root, "live", "https://example.com/live.mpd", discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.reset()
+	for _, filename := range append(unlisted, listed) {
+		if _, err := os.Stat(filepath.Join(ws.dir, filename)); !os.IsNotExist(err) {
+			t.Errorf("%s wasn't removed", filename)
+		}
+	}
+	if len(ws.state.Segments) != 0 {
+		t.Errorf("the state still lists %d segments", len(ws.state.Segments))
+	}
+	if _, err := os.Stat(filepath.Join(ws.dir, stateFilename)); err != nil {
+		t.Errorf("the state file should be kept - %v", err)
+	}
+}
+
+func TestWorkspaceResumeOnAnotherBaseURL(t *testing.T) {
+	root := t.TempDir()
+	manifestURL := "https://example.com/vod.mpd?token=1"
+	ws, err := openWorkspace(root, workspaceKey("", manifestURL, ""), manifestURL, discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseA, _ := url.Parse("https://cdn-a.example.com/vod/")
+	filename := "video_seg_1.m4s_seg_1"
+	if err := os.WriteFile(filepath.Join(ws.dir, filename), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ws.complete(filename, segmentKey("https://cdn-a.example.com/vod/video/seg_1.m4s?token=1", baseA), 4)
+	ws.save()
+	ws.close()
+
+	// the next run picks another weighted BaseURL and gets new tokens
+	manifestURL = "https://example.com/vod.mpd?token=2"
+	ws, err = openWorkspace(root, workspaceKey("", manifestURL, ""), manifestURL, discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseB, _ := url.Parse("https://cdn-b.example.com/mirror/vod/")
+	if !ws.verify(filename, segmentKey("https://cdn-b.example.com/mirror/vod/video/seg_1.m4s?token=2", baseB), false) {
+		t.Error("the segment downloaded from another BaseURL wasn't reused")
+	}
+	if ws.verify(filename, segmentKey("https://cdn-b.example.com/mirror/vod/video/seg_2.m4s?token=2", baseB), false) {
+		t.Error("another segment at the same position shouldn't be reused")
+	}
+	if _, err := os.Stat(filepath.Join(ws.dir, filename)); !os.IsNotExist(err) {
+		t.Error("the stale segment wasn't removed")
+	}
+}
+
+func TestWorkspaceIsolation(t *testing.T) {
+	manifestURL := "https://example.com/vod.mpd"
+	g1, err := NewGrabber(Options{ContentTypes: []ContentType{ContentTypeAudio}, Logger: discardLogger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g1.Close()
+	g2, err := NewGrabber(Options{Languages: []string{"fr"}, Logger: discardLogger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g2.Close()
+	job := &WJob{URL: manifestURL}
+	if workspaceKey("", manifestURL, g1.workspaceSettings(job)) == workspaceKey("", manifestURL, g2.workspaceSettings(job)) {
+		t.Error("grabbers downloading other tracks share the workspace of the manifest")
+	}
+
+	root := t.TempDir()
+	ws, err := openWorkspace(root, "job", manifestURL, discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openWorkspace(root, "job", manifestURL, discardLogger); !errors.Is(err, ErrWorkspaceInUse) {
+		t.Errorf("opening a workspace in use = %v, want %v", err, ErrWorkspaceInUse)
+	}
+	ws.close()
+	ws, err = openWorkspace(root, "job", manifestURL, discardLogger)
+	if err != nil {
+		t.Fatalf("the closed workspace can't be opened again - %v", err)
+	}
+	ws.close()
+}
+
+func TestWorkspaceNotCreatedWhenTheManifestFails(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/invalid.mpd":
+			w.Write([]byte("not a manifest"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	root := t.TempDir()
+	g, err := NewGrabber(Options{TmpFolder: root, Logger: discardLogger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	tests := []struct {
+		path string
+		want error
+	}{
+		{"/missing.mpd", ErrManifestFetch},
+		{"/invalid.mpd", ErrManifestParse},
+	}
+	for _, tt := range tests {
+		err := g.Download(srv.URL+tt.path, t.TempDir(), "out")
+		if !errors.Is(err, tt.want) {
+			t.Errorf("Download(%s) = %v, want %v", tt.path, err, tt.want)
+		}
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) > 0 {
+		t.Errorf("the failed jobs left workspaces: %v", entries)
+	}
+}
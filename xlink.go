@@ -0,0 +1,163 @@
+package mpdgrabber
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+const (
+	xlinkNamespace = "http://www.w3.org/1999/xlink"
+	// xlinkResolveToZero removes the element instead of fetching it
+	xlinkResolveToZero = "urn:mpeg:dash:resolve-to-zero:2013"
+	// maxXlinkDepth limits the nesting of remote elements
+	maxXlinkDepth = 5
+)
+
+// errXlinkChain is returned when the remote elements reference each other in
+// a loop or are nested deeper than maxXlinkDepth.
+var errXlinkChain = errors.New("invalid chain of remote elements")
+
+// parseManifest resolves the remote elements of the raw MPD data and parses
+// the result.
+func parseManifest(ctx context.Context, client *http.Client, data []byte, manifestURL *url.URL) (*manifest, error) {
+	data, err := resolveXlinks(ctx, client, data, manifestURL, []string{manifestURL.String()})
+	if err != nil {
+		return nil, err
+	}
+	return readManifest(data)
+}
+
+// xlinkSplice is a remote element and the content replacing it.
+type xlinkSplice struct {
+	start, end  int64
+	replacement []byte
+}
+
+// resolveXlinks replaces the Period and AdaptationSet elements referencing
+// remote content (xlink:href) with the fetched content. The remote content can
+// itself reference remote elements, chain holds the urls being resolved to
+// detect loops.
+// Elements are resolved whatever their xlink:actuate since the whole
+// presentation is downloaded. When the remote content can't be fetched, the
+// original element is kept, a loop or a chain too deep is an error.
+func resolveXlinks(ctx context.Context, client *http.Client, data []byte, baseURL *url.URL, chain []string) ([]byte, error) {
+	if !bytes.Contains(data, []byte("href")) {
+		return data, nil
+	}
+
+	var splices []xlinkSplice
+	d := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		start := d.InputOffset()
+		tok, err := d.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the xml to resolve the remote elements - %w", err)
+		}
+		el, ok := tok.(xml.StartElement)
+		if !ok || (el.Name.Local != "Period" && el.Name.Local != "AdaptationSet") {
+			continue
+		}
+		href := xlinkHref(el)
+		if href == "" {
+			continue
+		}
+		// the remote content replaces the entire element
+		if err := d.Skip(); err != nil {
+			return nil, fmt.Errorf("failed to parse the xml to resolve the remote elements - %w", err)
+		}
+		end := d.InputOffset()
+		replacement, err := remoteElement(ctx, client, el.Name.Local, href, data[start:end], baseURL, chain)
+		if err != nil {
+			return nil, err
+		}
+		splices = append(splices, xlinkSplice{
+			start:       start,
+			end:         end,
+			replacement: replacement,
+		})
+	}
+	if len(splices) == 0 {
+		return data, nil
+	}
+
+	resolved := make([]byte, 0, len(data))
+	var pos int64
+	for _, splice := range splices {
+		resolved = append(resolved, data[pos:splice.start]...)
+		resolved = append(resolved, splice.replacement...)
+		pos = splice.end
+	}
+	return append(resolved, data[pos:]...), nil
+}
+
+// remoteElement returns the content replacing an element with a xlink:href.
+func remoteElement(ctx context.Context, client *http.Client, name, href string, original []byte, baseURL *url.URL, chain []string) ([]byte, error) {
+	log := loggerFrom(ctx)
+	if href == xlinkResolveToZero {
+		log.Debug("removing the element resolving to zero", "element", name)
+		return nil, nil
+	}
+	ref, err := url.Parse(href)
+	if err != nil {
+		log.Warn("invalid xlink:href", "element", name, "url", href, "err", err)
+		return original, nil
+	}
+	remoteURL := baseURL.ResolveReference(ref)
+	for _, u := range chain {
+		if u == remoteURL.String() {
+			return nil, fmt.Errorf("the %s %s references itself - %w", name, remoteURL, errXlinkChain)
+		}
+	}
+	if len(chain) >= maxXlinkDepth {
+		return nil, fmt.Errorf("the %s %s is nested more than %d times - %w", name, remoteURL, maxXlinkDepth, errXlinkChain)
+	}
+
+	log.Debug("resolving the remote element", "element", name, "url", remoteURL.String())
+	fragment, err := fetchRemote(ctx, client, remoteURL.String())
+	if err != nil {
+		log.Warn("failed to fetch the remote element", "element", name, "url", remoteURL.String(), "err", err)
+		return original, nil
+	}
+	fragment = stripXMLDeclaration(fragment)
+	resolved, err := resolveXlinks(ctx, client, fragment, remoteURL, append(chain, remoteURL.String()))
+	if errors.Is(err, errXlinkChain) {
+		return nil, err
+	}
+	if err != nil {
+		log.Warn("failed to resolve the remote element", "element", name, "url", remoteURL.String(), "err", err)
+		return original, nil
+	}
+	return resolved, nil
+}
+
+// xlinkHref returns the xlink:href attribute of the element.
+func xlinkHref(el xml.StartElement) string {
+	for _, attr := range el.Attr {
+		// the prefix is kept as namespace if it wasn't declared
+		if attr.Name.Local == "href" && (attr.Name.Space == xlinkNamespace || attr.Name.Space == "xlink") {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// stripXMLDeclaration removes the <?xml ... ?> declaration so the content
+// can be inserted in another document.
+func stripXMLDeclaration(data []byte) []byte {
+	data = bytes.TrimLeft(data, "\ufeff \t\r\n")
+	if bytes.HasPrefix(data, []byte("<?xml")) {
+		if i := bytes.Index(data, []byte("?>")); i >= 0 {
+			return data[i+2:]
+		}
+	}
+	return data
+}
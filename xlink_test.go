@@ -0,0 +1,86 @@
+package mpdgrabber
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func xlinkTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	const header = `<?xml version="1.0"?><MPD xmlns="urn:mpeg:dash:schema:mpd:2011" xmlns:xlink="http://www.w3.org/1999/xlink" type="static" mediaPresentationDuration="PT20S">`
+	documents := map[string]string{
+		"/remote.mpd": header + `
+  <Period id="main" duration="PT10S"/>
+  <Period xlink:href="periods/ad.xml" xlink:actuate="onLoad"/>
+  <Period xlink:href="urn:mpeg:dash:resolve-to-zero:2013"/>
+</MPD>`,
+		"/periods/ad.xml": `<?xml version="1.0"?><Period id="ad" duration="PT10S"><AdaptationSet mimeType="video/mp4"/></Period>`,
+		"/loop.mpd": header + `
+  <Period xlink:href="periods/loop.xml"/>
+</MPD>`,
+		"/periods/loop.xml": `<Period xmlns:xlink="http://www.w3.org/1999/xlink" xlink:href="loop.xml"/>`,
+		"/deep.mpd": header + `
+  <Period xlink:href="periods/deep1.xml"/>
+</MPD>`,
+	}
+	for i, next := range []string{"deep2", "deep3", "deep4", "deep5", "deep6"} {
+		documents["/periods/deep"+string(rune('1'+i))+".xml"] = `<Period xmlns:xlink="http://www.w3.org/1999/xlink" xlink:href="` + next + `.xml"/>`
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		doc, ok := documents[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(doc))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestParseManifestResolvesXlinks(t *testing.T) {
+	srv := xlinkTestServer(t)
+	manifestURL, _ := url.Parse(srv.URL + "/remote.mpd")
+	data, err := fetchRange(context.Background(), srv.Client(), manifestURL.String(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := parseManifest(context.Background(), srv.Client(), data, manifestURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the remote period is spliced in and the one resolving to zero removed
+	var ids []string
+	for _, period := range m.Periods {
+		ids = append(ids, period.ID)
+	}
+	if len(ids) != 2 || ids[0] != "main" || ids[1] != "ad" {
+		t.Fatalf("periods = %v, want [main ad]", ids)
+	}
+	if len(m.Periods[1].AdaptationSets) != 1 {
+		t.Errorf("the remote period has %d adaptation sets, want 1", len(m.Periods[1].AdaptationSets))
+	}
+}
+
+func TestParseManifestXlinkChainGuards(t *testing.T) {
+	srv := xlinkTestServer(t)
+	g, err := NewGrabber(Options{TmpFolder: t.TempDir(), Logger: discardLogger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	for _, path := range []string{"/loop.mpd", "/deep.mpd"} {
+		err := g.Download(srv.URL+path, t.TempDir(), "out")
+		var manifestErr *ManifestError
+		if !errors.As(err, &manifestErr) || !errors.Is(err, ErrManifestParse) {
+			t.Errorf("Download(%s) = %v, want a ManifestError of %v", path, err, ErrManifestParse)
+		}
+		if !errors.Is(err, errXlinkChain) {
+			t.Errorf("Download(%s) = %v, want %v", path, err, errXlinkChain)
+		}
+	}
+}